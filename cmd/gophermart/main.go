@@ -1,7 +1,15 @@
 package main
 
-import "github.com/antonevtu/go-musthave-diploma/internal/app"
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/app"
+	"os"
+)
 
 func main() {
+	// подкоманда сверки балансов: gophermart reconcile [-repair] [флаги конфигурации]
+	if len(os.Args) > 1 && os.Args[1] == "reconcile" {
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+		os.Exit(app.Reconcile())
+	}
 	app.Run()
 }
@@ -0,0 +1,134 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// состояния автоматического выключателя
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+var ErrBreakerOpen = errors.New("accrual service circuit breaker is open")
+
+// метрики выключателя, публикуются в /debug/vars
+var (
+	metricBreakerState = expvar.NewString("accrual_breaker_state")
+	metricBreakerOpens = expvar.NewInt("accrual_breaker_opens")
+)
+
+// Breaker - автоматический выключатель запросов к системе начислений. После threshold ошибок подряд
+// выключатель размыкается, и запросы не выполняются в течение cooldown. Затем пропускается один пробный
+// запрос (half-open): успех замыкает выключатель, ошибка снова размыкает
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	// в состоянии half-open пробный запрос уже выполняется
+	probing bool
+	now     func() time.Time
+}
+
+// NewBreaker создает выключатель. threshold <= 0 - выключатель никогда не размыкается
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	b := &Breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+	b.setState(BreakerClosed)
+	return b
+}
+
+// Allow разрешает запрос либо возвращает ErrBreakerOpen. За каждым разрешенным запросом
+// должен следовать вызов Success или Failure
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return ErrBreakerOpen
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return ErrBreakerOpen
+		}
+		b.probing = true
+		return nil
+	}
+	return nil
+}
+
+// Success - система начислений ответила, выключатель замыкается
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// Failure - система начислений недоступна или ответила ошибкой
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || (b.threshold > 0 && b.failures >= b.threshold && b.state == BreakerClosed) {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+		metricBreakerOpens.Add(1)
+	}
+}
+
+// State возвращает текущее состояние выключателя
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Cooldown возвращает время, на которое размыкается выключатель
+func (b *Breaker) Cooldown() time.Duration {
+	return b.cooldown
+}
+
+// Ready ожидает, пока разомкнутый выключатель не будет готов пропустить пробный запрос
+func (b *Breaker) Ready(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		var wait time.Duration
+		if b.state == BreakerOpen {
+			wait = b.cooldown - b.now().Sub(b.openedAt)
+		}
+		b.mu.Unlock()
+		if wait <= 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (b *Breaker) setState(state string) {
+	b.state = state
+	metricBreakerState.Set(state)
+}
@@ -0,0 +1,76 @@
+package accrual
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(3, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	// ошибки, прерванные успехом, не размыкают выключатель
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.Allow())
+		b.Failure()
+	}
+	require.NoError(t, b.Allow())
+	b.Success()
+	for i := 0; i < 2; i++ {
+		require.NoError(t, b.Allow())
+		b.Failure()
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+
+	require.NoError(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// после паузы проходит только один пробный запрос
+	now = now.Add(10 * time.Second)
+	require.NoError(t, b.Allow())
+	assert.Equal(t, BreakerHalfOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// неудачная проба снова размыкает выключатель
+	b.Failure()
+	assert.Equal(t, BreakerOpen, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrBreakerOpen)
+
+	// удачная проба замыкает
+	now = now.Add(10 * time.Second)
+	require.NoError(t, b.Allow())
+	b.Success()
+	assert.Equal(t, BreakerClosed, b.State())
+	require.NoError(t, b.Allow())
+}
+
+func TestBreakerReady(t *testing.T) {
+	b := NewBreaker(1, 50*time.Millisecond)
+	require.NoError(t, b.Ready(context.Background()))
+
+	b.Failure()
+	start := time.Now()
+	require.NoError(t, b.Ready(context.Background()))
+	assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+	b.Allow()
+	b.Failure()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, b.Ready(ctx), context.Canceled)
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := NewBreaker(0, time.Second)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, b.Allow())
+		b.Failure()
+	}
+	assert.Equal(t, BreakerClosed, b.State())
+}
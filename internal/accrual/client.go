@@ -0,0 +1,84 @@
+package accrual
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// максимальный размер ответа системы начислений
+const maxResponseSize = 1 << 20
+
+// Client - клиент системы начислений
+type Client interface {
+	// Order запрашивает расчет начислений по заказу. Ошибка - система начислений не ответила
+	Order(ctx context.Context, order string) (Response, error)
+}
+
+// Response - ответ системы начислений
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// HTTPClient - клиент системы начислений по HTTP. Соединения переиспользуются между запросами,
+// каждый запрос ограничен по времени. Идентификатор запроса из контекста (middleware.RequestIDKey)
+// передается в заголовке X-Request-Id
+type HTTPClient struct {
+	baseURL string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// NewHTTPClient создает клиент системы начислений по адресу addr. Адрес без схемы считается http
+func NewHTTPClient(addr string, timeout time.Duration) (*HTTPClient, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid accrual system address: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid accrual system address %q", addr)
+	}
+	return &HTTPClient{
+		baseURL: strings.TrimRight(u.String(), "/"),
+		timeout: timeout,
+		client:  &http.Client{},
+	}, nil
+}
+
+func (c *HTTPClient) Order(ctx context.Context, order string) (Response, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/api/orders/"+url.PathEscape(order), nil)
+	if err != nil {
+		return Response{}, err
+	}
+	if id := middleware.GetReqID(ctx); id != "" {
+		req.Header.Set(middleware.RequestIDHeader, id)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return Response{}, fmt.Errorf("read response: %w", err)
+	}
+	return Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+}
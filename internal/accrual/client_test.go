@@ -0,0 +1,80 @@
+package accrual
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClientAddress(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "localhost:8080", want: "http://localhost:8080"},
+		{addr: "http://localhost:8080/", want: "http://localhost:8080"},
+		{addr: "https://accrual.example.com/base", want: "https://accrual.example.com/base"},
+		{addr: "ftp://localhost:8080", wantErr: true},
+		{addr: "http://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			c, err := NewHTTPClient(tt.addr, time.Second)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, c.baseURL)
+		})
+	}
+}
+
+func TestHTTPClientOrder(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		assert.Equal(t, "/api/orders/12%2F34", r.URL.EscapedPath())
+		assert.Equal(t, "replica-1/12/34/1", r.Header.Get("X-Request-Id"))
+		assert.Zero(t, r.ContentLength)
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+		_, _ = w.Write([]byte("No more than 10 requests per minute allowed"))
+	}))
+	defer srv.Close()
+
+	// адрес без схемы, номер заказа экранируется в пути
+	c, err := NewHTTPClient(strings.TrimPrefix(srv.URL, "http://"), time.Second)
+	require.NoError(t, err)
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "replica-1/12/34/1")
+	resp, err := c.Order(ctx, "12/34")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "7", resp.Header.Get("Retry-After"))
+	assert.Equal(t, "No more than 10 requests per minute allowed", string(resp.Body))
+}
+
+func TestHTTPClientTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c, err := NewHTTPClient(srv.URL, 50*time.Millisecond)
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = c.Order(context.Background(), "1")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,145 @@
+package accrual
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// пауза после 429, если система начислений не прислала Retry-After
+const defaultRetryAfter = 60 * time.Second
+
+// Limiter - общий для воркеров и продюсера token bucket. Скорость и паузы подстраиваются
+// под ответы 429 системы начислений
+type Limiter struct {
+	mu          sync.Mutex
+	rate        float64 // токенов в секунду, 0 - без ограничения
+	burst       float64
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+	now         func() time.Time
+}
+
+// NewLimiter создает ограничитель на perMinute запросов в минуту (0 - без ограничения)
+func NewLimiter(perMinute int) *Limiter {
+	l := &Limiter{now: time.Now}
+	l.SetRate(perMinute)
+	l.tokens = l.burst
+	l.last = l.now()
+	return l
+}
+
+// SetRate задает скорость perMinute запросов в минуту. Запас токенов - не больше чем на секунду
+func (l *Limiter) SetRate(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if perMinute <= 0 {
+		l.rate, l.burst = 0, 0
+		return
+	}
+	l.rate = float64(perMinute) / 60
+	l.burst = math.Max(1, l.rate)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// PauseFor приостанавливает все запросы на d
+func (l *Limiter) PauseFor(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := l.now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// Wait ожидает и забирает токен. Возвращает ошибку контекста при отмене
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.wait(ctx, true)
+}
+
+// Ready ожидает, пока запрос станет возможен, не забирая токен (для продюсера)
+func (l *Limiter) Ready(ctx context.Context) error {
+	return l.wait(ctx, false)
+}
+
+func (l *Limiter) wait(ctx context.Context, take bool) error {
+	for {
+		d := l.reserve(take)
+		if d <= 0 {
+			return nil
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// reserve забирает токен (take) и возвращает 0 либо время до появления токена
+func (l *Limiter) reserve(take bool) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Before(l.pausedUntil) {
+		return l.pausedUntil.Sub(now)
+	}
+	if l.rate == 0 {
+		return 0
+	}
+	l.refill()
+	if l.tokens >= 1 {
+		if take {
+			l.tokens--
+		}
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) refill() {
+	now := l.now()
+	if l.rate > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+}
+
+var reRequestsPerMinute = regexp.MustCompile(`No more than (\d+) requests per minute allowed`)
+
+// parseRetryAfter разбирает Retry-After: число секунд или HTTP-дата
+func parseRetryAfter(h string, now time.Time) (time.Duration, bool) {
+	if h == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(h); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second, true
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// parseRateLimit разбирает тело ответа 429 "No more than N requests per minute allowed"
+func parseRateLimit(body []byte) (int, bool) {
+	m := reRequestsPerMinute.FindSubmatch(body)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(m[1]))
+	return n, err == nil && n > 0
+}
@@ -0,0 +1,61 @@
+package accrual
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLimiter(120)
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	// запас - два запроса в секунду
+	assert.Zero(t, l.reserve(true))
+	assert.Zero(t, l.reserve(true))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(true))
+
+	now = now.Add(500 * time.Millisecond)
+	assert.Zero(t, l.reserve(false))
+	assert.Zero(t, l.reserve(true))
+	assert.Equal(t, 500*time.Millisecond, l.reserve(true))
+
+	l.PauseFor(10 * time.Second)
+	now = now.Add(time.Second)
+	assert.Equal(t, 9*time.Second, l.reserve(true))
+}
+
+func TestLimiterWaitCancel(t *testing.T) {
+	l := NewLimiter(0)
+	require.NoError(t, l.Wait(context.Background()))
+
+	l.PauseFor(time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Wait(ctx), context.DeadlineExceeded)
+}
+
+func TestParse429(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("60", now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Minute, d)
+
+	d, ok = parseRetryAfter("Mon, 19 Oct 2026 12:00:30 GMT", now)
+	assert.True(t, ok)
+	assert.Equal(t, 30*time.Second, d)
+
+	_, ok = parseRetryAfter("soon", now)
+	assert.False(t, ok)
+
+	n, ok := parseRateLimit([]byte("No more than 10 requests per minute allowed"))
+	assert.True(t, ok)
+	assert.Equal(t, 10, n)
+
+	_, ok = parseRateLimit([]byte("Too Many Requests"))
+	assert.False(t, ok)
+}
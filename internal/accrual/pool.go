@@ -1,170 +1,482 @@
 package accrual
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
 	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5/middleware"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
-	"io"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// максимальное количество воркеров пула
+const maxWorkers = 64
+
+// задержка перезапуска воркера после сбоя: от restartBase, удваивается до restartMax
+const (
+	restartBase = time.Second
+	restartMax  = 30 * time.Second
+)
+
+// время на возврат захваченных заказов в очередь при остановке пула
+const releaseTimeout = 5 * time.Second
+
+var ErrInvalidWorkers = fmt.Errorf("number of workers must be between 1 and %d", maxWorkers)
+
+// метрики пула, публикуются в /debug/vars
+var metricRestarts = expvar.NewInt("accrual_restarts")
+
 type PollT struct {
-	ProdChan    chan string
-	g           *errgroup.Group
-	ctx         context.Context
-	db          interface{}
-	ErrCh       chan error
-	serviceAddr string
-	log         *zap.SugaredLogger
+	ProdChan chan repository.QueueItem
+	g        *errgroup.Group
+	ctx      context.Context
+	db       interface{}
+	ErrCh    chan error
+	client   Client
+	log      *zap.SugaredLogger
+	repo     Poller
+	limiter  *Limiter
+	retry    retryPolicy
+	breaker  *Breaker
+
+	// заказы захватываются из общей очереди от имени экземпляра instanceID на время lease
+	instanceID string
+	lease      time.Duration
+
+	// ожидание при пустой очереди: от pollMin, удваивается до pollMax. Пока пул подписан на уведомления
+	// о новых заказах, очередь опрашивается раз в pollMax - только ради отложенных заказов
+	pollMin   time.Duration
+	pollMax   time.Duration
+	wake      chan struct{}
+	listening int32
+
+	// перезапуски после сбоев: задержка от restartBase до restartMax, после maxRestarts сбоев подряд
+	// ошибка считается неустранимой (0 - перезапуски не ограничены)
+	restartBase time.Duration
+	restartMax  time.Duration
+	maxRestarts int
+
+	// каналы остановки запущенных воркеров
+	mu      sync.Mutex
+	workers []chan struct{}
 }
 
 type Poller interface {
-	OldestFromQueue(ctx context.Context) (order string, err error)
-	DeferOrder(ctx context.Context, order, status string) error
-	FinalizeOrder(ctx context.Context, order, status string, accrual float64) error
+	ClaimBatch(ctx context.Context, n int, workerID string, lease time.Duration) ([]repository.QueueItem, error)
+	DeferOrder(ctx context.Context, workerID, order string, r repository.OrderRetry) error
+	FinalizeOrder(ctx context.Context, workerID, order, status string, accrual points.Amount, raw []byte) error
+	Listen(ctx context.Context, channel string, fn func(payload string)) error
+	ReleaseClaims(ctx context.Context, workerID string) (int, error)
 }
 
-func New(ctx context.Context, repo Poller, cfgApp cfg.Config, zapLog *zap.SugaredLogger) PollT {
-	prodChan := make(chan string, 1)
+// New запускает пул опроса системы начислений по адресу cfgApp.AccrualSystemAddress.
+// Каждый запрос ограничен по времени cfgApp.CtxTimeout
+func New(ctx context.Context, repo Poller, cfgApp cfg.Config, zapLog *zap.SugaredLogger) (*PollT, error) {
+	client, err := NewHTTPClient(cfgApp.AccrualSystemAddress, time.Duration(cfgApp.CtxTimeout)*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	poll := newPoll(ctx, repo, client, cfgApp, zapLog)
+	poll.start(cfgApp.AccrualWorkers)
+	return poll, nil
+}
+
+func newPoll(ctx context.Context, repo Poller, client Client, cfgApp cfg.Config, zapLog *zap.SugaredLogger) *PollT {
+	depth := cfgApp.AccrualQueueDepth
+	if depth < 0 {
+		depth = 0
+	}
+	prodChan := make(chan repository.QueueItem, depth)
 	g, ctx := errgroup.WithContext(ctx)
-	errCh := make(chan error)
-	poll := PollT{
-		ProdChan:    prodChan,
-		g:           g,
-		ctx:         ctx,
-		ErrCh:       errCh,
-		serviceAddr: cfgApp.AccrualSystemAddress + "/api/orders/",
-		log:         zapLog,
-	}
-	go poll.RunWorkers(repo)
-	go poll.RunProducer(repo)
+	// ошибка пула отправляется один раз и может остаться непрочитанной при остановке сервиса
+	errCh := make(chan error, 1)
+	poll := &PollT{
+		ProdChan: prodChan,
+		g:        g,
+		ctx:      ctx,
+		ErrCh:    errCh,
+		client:   client,
+		log:      zapLog,
+		repo:     repo,
+		limiter:  NewLimiter(cfgApp.AccrualRateLimit),
+		retry: newRetryPolicy(cfgApp.AccrualMaxAttempts,
+			time.Duration(cfgApp.AccrualRetryBase)*time.Second, time.Duration(cfgApp.AccrualRetryMax)*time.Second),
+		breaker:     NewBreaker(cfgApp.AccrualBreakerThreshold, time.Duration(cfgApp.AccrualBreakerCooldown)*time.Second),
+		pollMin:     time.Duration(cfgApp.AccrualPollMin) * time.Millisecond,
+		pollMax:     time.Duration(cfgApp.AccrualPollMax) * time.Millisecond,
+		wake:        make(chan struct{}, 1),
+		restartBase: restartBase,
+		restartMax:  restartMax,
+		maxRestarts: cfgApp.AccrualMaxRestarts,
+		instanceID:  cfgApp.InstanceID,
+		lease:       time.Duration(cfgApp.AccrualLease) * time.Second,
+	}
+	if poll.instanceID == "" {
+		poll.instanceID = defaultInstanceID()
+	}
+	if poll.lease <= 0 {
+		poll.lease = time.Minute
+	}
+	if poll.pollMin <= 0 {
+		poll.pollMin = 100 * time.Millisecond
+	}
+	if poll.pollMax < poll.pollMin {
+		poll.pollMax = poll.pollMin
+	}
 	return poll
 }
 
-func (p PollT) RunWorkers(repo Poller) {
-	numWorkers := 4
+// start запускает воркеры и producer. Неустранимая ошибка любого из них останавливает пул
+// и передается в ErrCh
+func (p *PollT) start(numWorkers int) {
+	p.RunWorkers(p.repo, numWorkers)
+	p.RunProducer(p.repo)
+	p.g.Go(func() error {
+		p.listen(p.repo)
+		return nil
+	})
+	go func() {
+		if err := p.g.Wait(); err != nil {
+			p.ErrCh <- fmt.Errorf("error in accrual pool: %w", err)
+		}
+	}()
+}
+
+func (p *PollT) RunWorkers(repo Poller, numWorkers int) {
+	if err := p.SetWorkers(numWorkers); err != nil {
+		p.log.Infow("invalid number of accrual workers, using 1", "workers", numWorkers)
+		_ = p.SetWorkers(1)
+	}
+}
+
+// Workers возвращает текущее количество воркеров
+func (p *PollT) Workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.workers)
+}
+
+// SetWorkers изменяет количество воркеров на ходу. Лишние воркеры останавливаются
+// после обработки текущего заказа
+func (p *PollT) SetWorkers(n int) error {
+	if n < 1 || n > maxWorkers {
+		return ErrInvalidWorkers
+	}
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
 
-	for i := 0; i < numWorkers; i++ {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for len(p.workers) < n {
+		stop := make(chan struct{})
+		p.workers = append(p.workers, stop)
 		p.g.Go(func() error {
-			for {
-				select {
-				case order := <-p.ProdChan:
-					err := p.processOrderAccrual(repo, order)
-					if err != nil {
-						return err
+			return p.supervise("worker", stop, func() error {
+				return p.worker(stop)
+			})
+		})
+	}
+	for len(p.workers) > n {
+		last := len(p.workers) - 1
+		close(p.workers[last])
+		p.workers = p.workers[:last]
+	}
+	p.log.Infow("accrual workers", "count", n)
+	return nil
+}
+
+func (p *PollT) worker(stop chan struct{}) error {
+	for {
+		select {
+		case item := <-p.ProdChan:
+			err := p.processOrderAccrual(p.repo, item)
+			if err != nil {
+				return err
+			}
+		case <-stop:
+			return nil
+		case <-p.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// supervise выполняет run и перезапускает его после ошибки или паники с растущей задержкой.
+// Ошибка возвращается, только если run завершался ошибкой maxRestarts раз подряд
+func (p *PollT) supervise(name string, stop chan struct{}, run func() error) error {
+	failures := 0
+	delay := p.restartBase
+	for {
+		started := time.Now()
+		err := safeRun(run)
+		if err == nil || p.ctx.Err() != nil {
+			return nil
+		}
+
+		// сбой после долгой работы без ошибок не считается повторным
+		if time.Since(started) > p.restartMax {
+			failures = 0
+			delay = p.restartBase
+		}
+		failures++
+		if p.maxRestarts > 0 && failures > p.maxRestarts {
+			p.log.Errorw("accrual "+name+" keeps failing, giving up", "failures", failures, "error", err)
+			return fmt.Errorf("accrual %s failed %d times in a row: %w", name, failures, err)
+		}
+		metricRestarts.Add(1)
+		p.log.Errorw("accrual "+name+" failed, restarting", "error", err, "restart_in", delay, "failures", failures)
+
+		select {
+		case <-p.ctx.Done():
+			return nil
+		case <-stop:
+			return nil
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > p.restartMax {
+			delay = p.restartMax
+		}
+	}
+}
+
+// safeRun выполняет run, превращая панику в ошибку
+func safeRun(run func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run()
+}
+
+func (p *PollT) RunProducer(repo Poller) {
+	p.g.Go(func() error {
+		return p.supervise("producer", nil, func() error {
+			return p.produce(repo)
+		})
+	})
+}
+
+func (p *PollT) produce(repo Poller) error {
+	wait := p.pollMin
+	for {
+		select {
+		case <-p.ctx.Done():
+			return nil
+		default:
+			// заказ забирается из очереди, только когда его можно отправить в систему начислений
+			if err := p.breaker.Ready(p.ctx); err != nil {
+				return nil
+			}
+			if err := p.limiter.Ready(p.ctx); err != nil {
+				return nil
+			}
+			// заказов захватывается столько, сколько воркеров могут взять в работу
+			items, err := repo.ClaimBatch(p.ctx, p.Workers(), p.instanceID, p.lease)
+			if err == nil {
+				wait = p.pollMin
+				for _, item := range items {
+					// при остановке пула непереданные заказы освобождает Close
+					select {
+					case p.ProdChan <- item:
+					case <-p.ctx.Done():
+						return nil
 					}
+				}
+			} else if errors.Is(err, repository.ErrEmptyQueue) {
+				// очередь пуста - ожидание растет, пока не появятся заказы. О новых заказах
+				// сообщает уведомление, поэтому при подписке ожидание сразу максимальное
+				if atomic.LoadInt32(&p.listening) == 1 {
+					wait = p.pollMax
+				}
+				select {
 				case <-p.ctx.Done():
 					return nil
+				case <-p.wake:
+					wait = p.pollMin
+					continue
+				case <-time.After(wait):
+				}
+				if wait *= 2; wait > p.pollMax {
+					wait = p.pollMax
 				}
+			} else {
+				return err
 			}
-		})
-	}
-
-	if err := p.g.Wait(); err != nil {
-		p.ErrCh <- fmt.Errorf("error in worker pool: %w", err)
+		}
 	}
 }
 
-func (p PollT) RunProducer(repo Poller) {
-	p.g.Go(func() error {
-		for {
+// listen подписывается на уведомления о новых заказах в очереди и будит producer.
+// При ошибке подписка возобновляется с растущей задержкой, а producer до тех пор опрашивает очередь чаще
+func (p *PollT) listen(repo Poller) {
+	delay := p.restartBase
+	for {
+		started := time.Now()
+		atomic.StoreInt32(&p.listening, 1)
+		err := repo.Listen(p.ctx, repository.QueueChannel, func(payload string) {
 			select {
-			case <-p.ctx.Done():
-				return nil
+			case p.wake <- struct{}{}:
 			default:
-				order, err := repo.OldestFromQueue(p.ctx)
-				if err == nil {
-					p.ProdChan <- order
-				} else if errors.Is(err, repository.ErrEmptyQueue) {
-					time.Sleep(100 * time.Millisecond)
-				} else {
-					return err
-				}
 			}
+		})
+		atomic.StoreInt32(&p.listening, 0)
+		if p.ctx.Err() != nil {
+			return
 		}
-	})
 
-	if err := p.g.Wait(); err != nil {
-		p.ErrCh <- fmt.Errorf("error in producer goroutine: %w", err)
+		if time.Since(started) > p.restartMax {
+			delay = p.restartBase
+		}
+		p.log.Infow("accrual queue listener failed, reconnecting", "error", err, "retry_in", delay)
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > p.restartMax {
+			delay = p.restartMax
+		}
+	}
+}
+
+// defaultInstanceID - идентификатор экземпляра сервиса по умолчанию: имя хоста и pid
+func defaultInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "gophermart"
 	}
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+// BreakerState возвращает состояние выключателя запросов к системе начислений
+func (p *PollT) BreakerState() string {
+	return p.breaker.State()
 }
 
-func (p PollT) Close() {
+// Close дожидается остановки пула и возвращает в очередь заказы, захваченные, но не обработанные
+// к моменту остановки, чтобы их не пришлось ждать до истечения срока захвата
+func (p *PollT) Close() {
 	_ = p.g.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseTimeout)
+	defer cancel()
+	n, err := p.repo.ReleaseClaims(ctx, p.instanceID)
+	if err != nil {
+		p.log.Errorw("unable to release claimed orders", "instance", p.instanceID, "error", err)
+	} else if n > 0 {
+		p.log.Infow("released claimed orders", "count", n)
+	}
 	p.log.Infow("accrual pool has closed")
 }
 
 type serviceResponce struct {
-	Order   string  `json:"order"`
-	Status  string  `json:"status"`
-	Accrual float64 `json:"accrual"`
+	Order   string        `json:"order"`
+	Status  string        `json:"status"`
+	Accrual points.Amount `json:"accrual"`
 }
 
-func (p PollT) processOrderAccrual(repo Poller, order string) error {
-	// make request to service
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodGet, p.serviceAddr+order, bytes.NewBufferString(""))
+func (p *PollT) processOrderAccrual(repo Poller, item repository.QueueItem) error {
+	order := item.Order
+	// общий для всех воркеров лимит запросов к системе начислений. Ожидание ограничено половиной
+	// срока захвата: остальное время - на запрос и сохранение результата. Если заказ не дождался
+	// запроса, он возвращается в очередь без расхода попытки, пока reaper не передал его другому экземпляру
+	ctx, cancel := context.WithDeadline(p.ctx, item.ClaimedUntil.Add(-p.lease/2))
+	err := p.limiter.Wait(ctx)
+	if err == nil {
+		err = ctx.Err()
+	}
+	cancel()
+	if p.ctx.Err() != nil {
+		return nil
+	}
 	if err != nil {
-		return err
+		return repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.postpone(item, "claim expired while waiting for rate limit", 0))
 	}
-	resp, err := client.Do(req)
+
+	// система начислений недоступна - заказ ждет окончания паузы выключателя, попытка не расходуется
+	if err := p.breaker.Allow(); err != nil {
+		return repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.postpone(item, err.Error(), p.breaker.Cooldown()))
+	}
+
+	// запрос к системе начислений с идентификатором для поиска в логах обеих систем
+	requestID := fmt.Sprintf("%s/%s/%d", p.instanceID, order, item.Attempt)
+	resp, err := p.client.Order(context.WithValue(p.ctx, middleware.RequestIDKey, requestID), order)
 	if err != nil {
-		return err
+		p.breaker.Failure()
+		p.log.Infow("accrual service request failed", "request_id", requestID, "breaker", p.breaker.State())
+		return p.deferFailed(repo, item, err)
 	}
-	defer resp.Body.Close()
-	p.log.Debugw("Запрошены баллы по заказу:", "order", order)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		p.breaker.Failure()
+	} else {
+		p.breaker.Success()
+	}
+	p.log.Debugw("Запрошены баллы по заказу:", "order", order, "request_id", requestID)
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return err
-		}
+		body := resp.Body
 		res := serviceResponce{}
 		err = json.Unmarshal(body, &res)
 		if err != nil {
-			return err
+			return p.deferFailed(repo, item, fmt.Errorf("decode response: %w", err))
 		}
 
 		p.log.Debugw("Пришел ответ 200 по заказу:", "order", order, "body", string(body))
 
-		if (res.Status == repository.AccrualInvalid) || (res.Status == repository.AccrualProcessed) {
-			err = repo.FinalizeOrder(p.ctx, order, res.Status, res.Accrual)
+		switch res.Status {
+		case repository.AccrualInvalid, repository.AccrualProcessed:
+			err = repo.FinalizeOrder(p.ctx, p.instanceID, order, res.Status, res.Accrual, body)
+			if err != nil {
+				return p.deferFailed(repo, item, fmt.Errorf("finalize order: %w", err))
+			}
+		case repository.AccrualProcessing:
+			r := repository.OrderRetry{Status: repository.AccrualProcessing, Raw: body}
+			err := repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.next(item, r))
 			if err != nil {
 				return err
 			}
-		} else {
-			err := repo.DeferOrder(p.ctx, order, "")
+		default:
+			// REGISTERED - заказ принят системой начислений, для пользователя остается NEW
+			err := repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.next(item, repository.OrderRetry{}))
 			if err != nil {
 				return err
 			}
 		}
 
 	case http.StatusTooManyRequests:
+		pause := p.throttle(resp)
 		p.log.Debugw("Пришел ответ 429 по заказу:", "order", order)
-		err := repo.DeferOrder(p.ctx, order, "")
+		err := repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.postpone(item, "too many requests", pause))
 		if err != nil {
 			return err
 		}
-		time.Sleep(60 * time.Second)
 
 	case http.StatusInternalServerError:
 		p.log.Debugw("Пришел ответ 500 по заказу:", "order", order)
-		err := repo.DeferOrder(p.ctx, order, "")
+		r := repository.OrderRetry{Error: "accrual service internal error"}
+		err := repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.next(item, r))
 		if err != nil {
 			return err
 		}
 
 	default:
 		p.log.Debugw("Пришел ответ по заказу", "status_code", resp.StatusCode, "order", order)
-		err := repo.DeferOrder(p.ctx, order, "")
+		r := repository.OrderRetry{Error: fmt.Sprintf("unexpected response status %d", resp.StatusCode)}
+		err := repo.DeferOrder(p.ctx, p.instanceID, order, p.retry.next(item, r))
 		if err != nil {
 			return err
 		}
@@ -172,3 +484,28 @@ func (p PollT) processOrderAccrual(repo Poller, order string) error {
 
 	return nil
 }
+
+// deferFailed возвращает в очередь заказ, обработка которого завершилась ошибкой. Ошибка пишется
+// в лог и в очередь, воркер продолжает работу. Ошибкой воркера считается только невозможность вернуть заказ
+func (p *PollT) deferFailed(repo Poller, item repository.QueueItem, err error) error {
+	p.log.Errorw("accrual order processing failed", "order", item.Order, "attempt", item.Attempt, "error", err)
+	return repo.DeferOrder(p.ctx, p.instanceID, item.Order, p.retry.next(item, repository.OrderRetry{Error: err.Error()}))
+}
+
+// throttle приостанавливает запросы всех воркеров на Retry-After и подстраивает скорость
+// под лимит из тела ответа 429. Возвращает длительность паузы
+func (p *PollT) throttle(resp Response) time.Duration {
+	pause, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		pause = defaultRetryAfter
+	}
+	p.limiter.PauseFor(pause)
+
+	if n, ok := parseRateLimit(resp.Body); ok {
+		p.limiter.SetRate(n)
+		p.log.Infow("accrual service rate limit", "requests_per_minute", n, "pause", pause)
+	} else {
+		p.log.Infow("accrual service asked to slow down", "pause", pause)
+	}
+	return pause
+}
@@ -0,0 +1,394 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakePoller - очередь заказов в памяти. Отложенные заказы в очередь не возвращаются
+type fakePoller struct {
+	mu        sync.Mutex
+	queue     []string
+	attempts  map[string]int
+	deferred  map[string]repository.OrderRetry
+	finalized map[string]string
+	claimed   map[string]bool
+	claims    int
+	// уведомления о новых заказах для Listen
+	notify chan string
+
+	// сбои хранилища: вызываются перед соответствующей операцией
+	claimErr    func() error
+	deferErr    func(order string) error
+	finalizeErr func(order string) error
+}
+
+func newFakePoller(orders ...string) *fakePoller {
+	return &fakePoller{
+		queue:     orders,
+		attempts:  make(map[string]int),
+		deferred:  make(map[string]repository.OrderRetry),
+		finalized: make(map[string]string),
+		claimed:   make(map[string]bool),
+		notify:    make(chan string),
+	}
+}
+
+func (f *fakePoller) ClaimBatch(ctx context.Context, n int, workerID string, lease time.Duration) ([]repository.QueueItem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.claims++
+	if f.claimErr != nil {
+		if err := f.claimErr(); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.queue) == 0 {
+		return nil, repository.ErrEmptyQueue
+	}
+	if n > len(f.queue) {
+		n = len(f.queue)
+	}
+	items := make([]repository.QueueItem, 0, n)
+	for _, order := range f.queue[:n] {
+		f.attempts[order]++
+		f.claimed[order] = true
+		items = append(items, repository.QueueItem{Order: order, Attempt: f.attempts[order], ClaimedUntil: time.Now().Add(lease)})
+	}
+	f.queue = f.queue[n:]
+	return items, nil
+}
+
+func (f *fakePoller) DeferOrder(ctx context.Context, workerID, order string, r repository.OrderRetry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.deferErr != nil {
+		if err := f.deferErr(order); err != nil {
+			return err
+		}
+	}
+	f.deferred[order] = r
+	delete(f.claimed, order)
+	return nil
+}
+
+func (f *fakePoller) FinalizeOrder(ctx context.Context, workerID, order, status string, accrual points.Amount, raw []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.finalizeErr != nil {
+		if err := f.finalizeErr(order); err != nil {
+			return err
+		}
+	}
+	f.finalized[order] = status
+	delete(f.claimed, order)
+	return nil
+}
+
+func (f *fakePoller) Listen(ctx context.Context, channel string, fn func(payload string)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case order := <-f.notify:
+			fn(order)
+		}
+	}
+}
+
+func (f *fakePoller) ReleaseClaims(ctx context.Context, workerID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.claimed)
+	for order := range f.claimed {
+		f.queue = append(f.queue, order)
+		delete(f.claimed, order)
+	}
+	return n, nil
+}
+
+func (f *fakePoller) claimCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.claims
+}
+
+func (f *fakePoller) push(order string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = append(f.queue, order)
+}
+
+func (f *fakePoller) isDeferred(order string) (repository.OrderRetry, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r, ok := f.deferred[order]
+	return r, ok
+}
+
+func (f *fakePoller) isFinalized(order string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.finalized[order]
+	return ok
+}
+
+// mockClient - система начислений: заказы с префиксом "bad" получают битый JSON, с префиксом "err" -
+// ответ 500, с префиксом "slow" - ответ с задержкой, остальные обработаны. Идентификаторы запросов сохраняются
+type mockClient struct {
+	mu         sync.Mutex
+	requestIDs []string
+}
+
+func (c *mockClient) Order(ctx context.Context, order string) (Response, error) {
+	c.mu.Lock()
+	c.requestIDs = append(c.requestIDs, middleware.GetReqID(ctx))
+	c.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(order, "bad"):
+		return Response{StatusCode: http.StatusOK, Body: []byte(`{"order":`)}, nil
+	case strings.HasPrefix(order, "err"):
+		return Response{StatusCode: http.StatusInternalServerError}, nil
+	case strings.HasPrefix(order, "slow"):
+		select {
+		case <-ctx.Done():
+			return Response{}, ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	body := fmt.Sprintf(`{"order":%q,"status":"PROCESSED","accrual":5}`, order)
+	return Response{StatusCode: http.StatusOK, Body: []byte(body)}, nil
+}
+
+func testConfig(maxRestarts int) cfg.Config {
+	return cfg.Config{
+		AccrualQueueDepth:  0,
+		AccrualPollMin:     5,
+		AccrualPollMax:     20,
+		AccrualMaxAttempts: 10,
+		AccrualRetryBase:   1,
+		AccrualRetryMax:    1,
+		AccrualMaxRestarts: maxRestarts,
+	}
+}
+
+func startTestPool(t *testing.T, repo Poller, cfgApp cfg.Config) *PollT {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newPoll(ctx, repo, &mockClient{}, cfgApp, zap.NewNop().Sugar())
+	p.restartBase = 10 * time.Millisecond
+	p.restartMax = 40 * time.Millisecond
+	p.start(2)
+	t.Cleanup(func() {
+		cancel()
+		p.Close()
+	})
+	return p
+}
+
+func assertNoPoolError(t *testing.T, p *PollT) {
+	select {
+	case err := <-p.ErrCh:
+		t.Fatalf("pool stopped: %v", err)
+	default:
+	}
+}
+
+func TestPoolDefersBrokenResponse(t *testing.T) {
+	repo := newFakePoller("bad1", "ok1")
+	p := startTestPool(t, repo, testConfig(1))
+
+	require.Eventually(t, func() bool { return repo.isFinalized("ok1") }, time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { _, ok := repo.isDeferred("bad1"); return ok }, time.Second, 5*time.Millisecond)
+	r, _ := repo.isDeferred("bad1")
+	assert.Contains(t, r.Error, "decode response")
+	assert.Equal(t, 1, r.Attempts)
+	assertNoPoolError(t, p)
+}
+
+func TestPoolDefersFailedFinalize(t *testing.T) {
+	repo := newFakePoller("ok1")
+	repo.finalizeErr = func(order string) error { return errors.New("connection reset") }
+	p := startTestPool(t, repo, testConfig(1))
+
+	require.Eventually(t, func() bool { _, ok := repo.isDeferred("ok1"); return ok }, time.Second, 5*time.Millisecond)
+	r, _ := repo.isDeferred("ok1")
+	assert.Contains(t, r.Error, "finalize order: connection reset")
+	assertNoPoolError(t, p)
+}
+
+func TestPoolRestartsFailedWorker(t *testing.T) {
+	restarts := metricRestarts.Value()
+
+	// первый возврат заказа в очередь не удается - воркер перезапускается и обрабатывает следующие заказы
+	repo := newFakePoller("err1")
+	failed := false
+	repo.deferErr = func(order string) error {
+		if !failed {
+			failed = true
+			return errors.New("database is unavailable")
+		}
+		return nil
+	}
+	p := startTestPool(t, repo, testConfig(3))
+
+	require.Eventually(t, func() bool { return metricRestarts.Value() > restarts }, time.Second, 5*time.Millisecond)
+	repo.push("err2")
+	repo.push("ok1")
+	require.Eventually(t, func() bool { return repo.isFinalized("ok1") }, time.Second, 5*time.Millisecond)
+	_, ok := repo.isDeferred("err2")
+	assert.True(t, ok)
+	assertNoPoolError(t, p)
+}
+
+func TestPoolRecoversPanic(t *testing.T) {
+	restarts := metricRestarts.Value()
+
+	repo := newFakePoller("ok1")
+	panicked := false
+	repo.finalizeErr = func(order string) error {
+		if !panicked {
+			panicked = true
+			panic("unexpected nil")
+		}
+		return nil
+	}
+	p := startTestPool(t, repo, testConfig(3))
+
+	require.Eventually(t, func() bool { return metricRestarts.Value() > restarts }, time.Second, 5*time.Millisecond)
+	repo.push("ok2")
+	require.Eventually(t, func() bool { return repo.isFinalized("ok2") }, time.Second, 5*time.Millisecond)
+	assertNoPoolError(t, p)
+}
+
+func TestPoolEscalatesPersistentFailure(t *testing.T) {
+	repo := newFakePoller()
+	repo.claimErr = func() error { return errors.New("database is unavailable") }
+	p := startTestPool(t, repo, testConfig(2))
+
+	select {
+	case err := <-p.ErrCh:
+		assert.Contains(t, err.Error(), "producer failed 3 times in a row")
+		assert.Contains(t, err.Error(), "database is unavailable")
+	case <-time.After(2 * time.Second):
+		t.Fatal("persistent failure was not escalated")
+	}
+}
+
+func TestPoolWakesOnNotification(t *testing.T) {
+	repo := newFakePoller()
+	cfgApp := testConfig(1)
+	cfgApp.AccrualPollMax = 10000
+	startTestPool(t, repo, cfgApp)
+
+	// без уведомлений очередь почти не опрашивается
+	time.Sleep(300 * time.Millisecond)
+	assert.LessOrEqual(t, repo.claimCount(), 3)
+
+	// загруженный заказ забирается сразу, не дожидаясь опроса раз в pollMax
+	start := time.Now()
+	repo.push("ok1")
+	repo.notify <- "ok1"
+	require.Eventually(t, func() bool { return repo.isFinalized("ok1") }, time.Second, time.Millisecond)
+	assert.Less(t, time.Since(start), 200*time.Millisecond)
+}
+
+func TestPoolPollsWithoutListener(t *testing.T) {
+	repo := newFakePoller()
+	cfgApp := testConfig(1)
+	cfgApp.AccrualPollMax = 10000
+	p := newPoll(context.Background(), repo, &mockClient{}, cfgApp, zap.NewNop().Sugar())
+
+	// без подписки на уведомления ожидание растет от pollMin
+	ctx, cancel := context.WithCancel(context.Background())
+	p.ctx = ctx
+	go func() { _ = p.produce(repo) }()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	assert.GreaterOrEqual(t, repo.claimCount(), 3)
+}
+
+func TestPoolCloseReleasesClaims(t *testing.T) {
+	repo := newFakePoller("slow1", "slow2", "slow3")
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newPoll(ctx, repo, &mockClient{}, testConfig(1), zap.NewNop().Sugar())
+	p.start(1)
+
+	// единственный воркер занят первым заказом, producer ждет его со вторым
+	require.Eventually(t, func() bool { return repo.claimCount() >= 2 }, time.Second, time.Millisecond)
+	cancel()
+
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("pool did not close")
+	}
+
+	// прерванный запрос первого заказа отложен, захваченный второй вернулся в очередь
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	assert.Empty(t, repo.claimed)
+	assert.Contains(t, repo.deferred, "slow1")
+	assert.ElementsMatch(t, []string{"slow2", "slow3"}, repo.queue)
+}
+
+func TestPoolPropagatesRequestID(t *testing.T) {
+	repo := newFakePoller("ok1")
+	client := &mockClient{}
+	cfgApp := testConfig(1)
+	cfgApp.InstanceID = "replica-1"
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newPoll(ctx, repo, client, cfgApp, zap.NewNop().Sugar())
+	p.start(1)
+	t.Cleanup(func() {
+		cancel()
+		p.Close()
+	})
+
+	require.Eventually(t, func() bool { return repo.isFinalized("ok1") }, time.Second, 5*time.Millisecond)
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	assert.Equal(t, []string{"replica-1/ok1/1"}, client.requestIDs)
+}
+
+func TestPoolDefersOrderBeforeClaimExpires(t *testing.T) {
+	repo := newFakePoller("ok1")
+	ctx, cancel := context.WithCancel(context.Background())
+	p := newPoll(ctx, repo, &mockClient{}, testConfig(1), zap.NewNop().Sugar())
+	p.lease = 20 * time.Millisecond
+	// система начислений приостановила запросы сразу после захвата заказа
+	repo.claimErr = func() error {
+		p.limiter.PauseFor(time.Hour)
+		return nil
+	}
+	p.start(1)
+	t.Cleanup(func() {
+		cancel()
+		p.Close()
+	})
+
+	require.Eventually(t, func() bool { _, ok := repo.isDeferred("ok1"); return ok }, time.Second, 5*time.Millisecond)
+	r, _ := repo.isDeferred("ok1")
+	assert.Contains(t, r.Error, "claim expired")
+	assert.Equal(t, 0, r.Attempts)
+	assert.False(t, repo.isFinalized("ok1"))
+	assertNoPoolError(t, p)
+}
@@ -0,0 +1,191 @@
+package accrual
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// интеграционные тесты общей очереди выполняются только с локальной БД: go test ./internal/accrual -args -d <url>
+var databaseURI = flag.String("d", os.Getenv("DATABASE_URI"), "postgres url for integration tests")
+
+func testDB(t *testing.T) *repository.DBT {
+	if *databaseURI == "" {
+		t.Skip("postgres url is not set (-d or DATABASE_URI)")
+	}
+	db, err := repository.NewDB(context.Background(), *databaseURI, zap.NewNop().Sugar(), true)
+	require.NoError(t, err)
+	t.Cleanup(db.Close)
+	return &db
+}
+
+// postOrders ставит в очередь n заказов нового пользователя
+func postOrders(t *testing.T, db *repository.DBT, n int) (int, []string) {
+	ctx := context.Background()
+	userID, err := db.Register(ctx, repository.RegisterNewUser{Login: "queue", PwdHash: "h", PwdSalt: "s", JWTSalt: "j", ReferralCode: "QUEUE1"})
+	require.NoError(t, err)
+
+	orders := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		order := strconv.Itoa(1000000 + i)
+		require.NoError(t, db.PostOrder(ctx, userID, order))
+		orders = append(orders, order)
+	}
+	return userID, orders
+}
+
+func TestClaimBatchConcurrent(t *testing.T) {
+	db := testDB(t)
+	_, orders := postOrders(t, db, 50)
+
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < 5; w++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			for {
+				items, err := db.ClaimBatch(context.Background(), 3, workerID, time.Minute)
+				if errors.Is(err, repository.ErrEmptyQueue) {
+					return
+				}
+				if !assert.NoError(t, err) {
+					return
+				}
+				mu.Lock()
+				for _, item := range items {
+					claimed[item.Order]++
+				}
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("worker-%d", w))
+	}
+	wg.Wait()
+
+	require.Len(t, claimed, len(orders))
+	for _, order := range orders {
+		assert.Equal(t, 1, claimed[order], "order %s", order)
+	}
+}
+
+func TestPoolsShareQueue(t *testing.T) {
+	db := testDB(t)
+	userID, orders := postOrders(t, db, 30)
+
+	// система начислений считает запросы по каждому заказу
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order := strings.TrimPrefix(r.URL.Path, "/api/orders/")
+		mu.Lock()
+		requests[order]++
+		mu.Unlock()
+		fmt.Fprintf(w, `{"order":%q,"status":"PROCESSED","accrual":5}`, order)
+	}))
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for i := 0; i < 3; i++ {
+		p, err := New(ctx, db, cfg.Config{
+			AccrualSystemAddress: srv.URL,
+			AccrualWorkers:       2,
+			AccrualPollMin:       5,
+			AccrualPollMax:       50,
+			AccrualMaxAttempts:   10,
+			AccrualRetryBase:     1,
+			AccrualRetryMax:      1,
+			AccrualLease:         60,
+			InstanceID:           fmt.Sprintf("instance-%d", i),
+		}, zap.NewNop().Sugar())
+		require.NoError(t, err)
+		t.Cleanup(p.Close)
+	}
+	t.Cleanup(cancel)
+
+	require.Eventually(t, func() bool {
+		list, err := db.GetOrders(context.Background(), userID)
+		if err != nil || len(list) != len(orders) {
+			return false
+		}
+		for _, o := range list {
+			if o.Status != repository.AccrualProcessed {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 20*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, order := range orders {
+		assert.Equal(t, 1, requests[order], "order %s", order)
+	}
+}
+
+func TestReleaseClaims(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	_, orders := postOrders(t, db, 4)
+
+	// захват с истекшим сроком освобождается reaper'ом, с действующим - только самим экземпляром
+	_, err := db.ClaimBatch(ctx, 2, "crashed", time.Millisecond)
+	require.NoError(t, err)
+	_, err = db.ClaimBatch(ctx, 2, "alive", time.Minute)
+	require.NoError(t, err)
+	_, err = db.ClaimBatch(ctx, 1, "other", time.Minute)
+	require.ErrorIs(t, err, repository.ErrEmptyQueue)
+
+	time.Sleep(10 * time.Millisecond)
+	n, err := db.ReleaseExpiredClaims(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	n, err = db.ReleaseClaims(ctx, "alive")
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	items, err := db.ClaimBatch(ctx, len(orders), "other", time.Minute)
+	require.NoError(t, err)
+	assert.Len(t, items, len(orders))
+}
+
+func TestDeferOrderChecksClaim(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	_, orders := postOrders(t, db, 1)
+
+	// захват истек, reaper передал заказ другому экземпляру
+	_, err := db.ClaimBatch(ctx, 1, "stale", time.Millisecond)
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	_, err = db.ReleaseExpiredClaims(ctx)
+	require.NoError(t, err)
+	items, err := db.ClaimBatch(ctx, 1, "owner", time.Minute)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+
+	// результаты прежнего владельца не снимают новый захват
+	require.NoError(t, db.DeferOrder(ctx, "stale", orders[0], repository.OrderRetry{Attempts: 1}))
+	require.NoError(t, db.FinalizeOrder(ctx, "stale", orders[0], repository.AccrualProcessed, 5, nil))
+	_, err = db.ClaimBatch(ctx, 1, "other", time.Minute)
+	require.ErrorIs(t, err, repository.ErrEmptyQueue)
+
+	n, err := db.ReleaseClaims(ctx, "owner")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
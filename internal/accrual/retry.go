@@ -0,0 +1,56 @@
+package accrual
+
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy - политика повторов опроса заказа
+type retryPolicy struct {
+	maxAttempts int
+	base        time.Duration
+	max         time.Duration
+	// rnd возвращает случайное число из [0, 1)
+	rnd func() float64
+}
+
+// backoff - задержка перед следующей попыткой: base * 2^(attempt-1), не более max.
+// Случайный разброс в пределах половины задержки не дает заказам, отложенным одновременно, вернуться разом
+func (rp retryPolicy) backoff(attempt int) time.Duration {
+	delay := rp.base
+	for i := 1; i < attempt && delay < rp.max; i++ {
+		delay *= 2
+	}
+	if delay > rp.max {
+		delay = rp.max
+	}
+	return delay/2 + time.Duration(rp.rnd()*float64(delay/2))
+}
+
+// next засчитывает попытку item и определяет, когда повторить опрос или что попытки исчерпаны
+func (rp retryPolicy) next(item repository.QueueItem, r repository.OrderRetry) repository.OrderRetry {
+	r.Attempts = item.Attempt
+	if rp.maxAttempts > 0 && item.Attempt >= rp.maxAttempts {
+		r.DeadLetter = true
+		return r
+	}
+	r.RetryIn = rp.backoff(item.Attempt)
+	return r
+}
+
+// postpone возвращает заказ в очередь на время паузы, не засчитывая попытку: система начислений
+// не отказала в обработке заказа, а попросила снизить нагрузку или запрос к ней не выполнялся
+func (rp retryPolicy) postpone(item repository.QueueItem, reason string, pause time.Duration) repository.OrderRetry {
+	return repository.OrderRetry{Error: reason, Attempts: item.Attempt - 1, RetryIn: pause}
+}
+
+func newRetryPolicy(maxAttempts int, base, max time.Duration) retryPolicy {
+	if base <= 0 {
+		base = time.Second
+	}
+	if max < base {
+		max = base
+	}
+	return retryPolicy{maxAttempts: maxAttempts, base: base, max: max, rnd: rand.Float64}
+}
@@ -0,0 +1,50 @@
+package accrual
+
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	rp := newRetryPolicy(0, time.Second, 60*time.Second)
+
+	// без разброса - нижняя граница, половина задержки
+	rp.rnd = func() float64 { return 0 }
+	assert.Equal(t, 500*time.Millisecond, rp.backoff(1))
+	assert.Equal(t, time.Second, rp.backoff(2))
+	assert.Equal(t, 4*time.Second, rp.backoff(4))
+	assert.Equal(t, 30*time.Second, rp.backoff(100))
+
+	// максимальный разброс не выходит за полную задержку
+	rp.rnd = func() float64 { return 0.999999 }
+	assert.InDelta(t, float64(8*time.Second), float64(rp.backoff(4)), float64(time.Millisecond))
+	assert.LessOrEqual(t, rp.backoff(100), 60*time.Second)
+}
+
+func TestRetryNext(t *testing.T) {
+	rp := newRetryPolicy(3, time.Second, time.Minute)
+	rp.rnd = func() float64 { return 0 }
+
+	r := rp.next(repository.QueueItem{Order: "1", Attempt: 2}, repository.OrderRetry{Error: "boom"})
+	assert.Equal(t, 2, r.Attempts)
+	assert.Equal(t, time.Second, r.RetryIn)
+	assert.False(t, r.DeadLetter)
+	assert.Equal(t, "boom", r.Error)
+
+	r = rp.next(repository.QueueItem{Order: "1", Attempt: 3}, repository.OrderRetry{})
+	assert.True(t, r.DeadLetter)
+	assert.Equal(t, 3, r.Attempts)
+
+	// 429 не расходует попытки
+	r = rp.postpone(repository.QueueItem{Order: "1", Attempt: 3}, "too many requests", 10*time.Second)
+	assert.Equal(t, 2, r.Attempts)
+	assert.Equal(t, 10*time.Second, r.RetryIn)
+	assert.Equal(t, "too many requests", r.Error)
+	assert.False(t, r.DeadLetter)
+
+	// без ограничения попыток заказ не уходит в dead letter
+	rp.maxAttempts = 0
+	assert.False(t, rp.next(repository.QueueItem{Attempt: 1000}, repository.OrderRetry{}).DeadLetter)
+}
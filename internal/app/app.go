@@ -2,11 +2,16 @@ package app
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/antonevtu/go-musthave-diploma/internal/accrual"
 	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/events"
 	"github.com/antonevtu/go-musthave-diploma/internal/handlers"
+	"github.com/antonevtu/go-musthave-diploma/internal/jobs"
 	"github.com/antonevtu/go-musthave-diploma/internal/logger"
+	"github.com/antonevtu/go-musthave-diploma/internal/reconcile"
 	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/antonevtu/go-musthave-diploma/internal/webhooks"
 	"log"
 	"net"
 	"net/http"
@@ -39,12 +44,86 @@ func Run() {
 	}
 	defer dbPool.Close()
 	repo := &dbPool
+	repo.SetPointsLifetime(cfgApp.PointsLifetimeMonths)
+	repo.SetLoyaltyTiers(cfgApp.LoyaltyTiers)
+	repo.SetReferralBonus(repository.ReferralBonus{Referrer: cfgApp.ReferrerBonus, Referred: cfgApp.ReferredBonus})
+	repo.SetWithdrawalLimits(repository.WithdrawalLimits{
+		MaxPerWithdrawal: cfgApp.WithdrawMax,
+		Daily:            cfgApp.WithdrawDailyLimit,
+		Weekly:           cfgApp.WithdrawWeeklyLimit,
+		MinAccountAge:    cfgApp.WithdrawMinAccountAge,
+		MaxOrderShare:    cfgApp.WithdrawMaxOrderShare,
+	})
+
+	// сгорание баллов с истекшим сроком жизни
+	go jobs.Every(ctx, time.Duration(cfgApp.ExpirationInterval)*time.Second, "points expiration", zLog, func(ctx context.Context) error {
+		n, err := repo.ExpireLots(ctx)
+		if n > 0 {
+			zLog.Infow("expired point lots", "count", n)
+		}
+		return err
+	})
+
+	// снятие просроченных резервов баллов
+	go jobs.Every(ctx, time.Duration(cfgApp.HoldExpirationInterval)*time.Second, "holds expiration", zLog, func(ctx context.Context) error {
+		n, err := repo.ExpireHolds(ctx)
+		if n > 0 {
+			zLog.Infow("expired holds", "count", n)
+		}
+		return err
+	})
+
+	// понижение уровней программы лояльности, когда начисления выходят из окна 12 месяцев
+	go jobs.Every(ctx, time.Duration(cfgApp.TierRefreshInterval)*time.Second, "tiers refresh", zLog, func(ctx context.Context) error {
+		n, err := repo.RefreshTiers(ctx)
+		if n > 0 {
+			zLog.Infow("refreshed loyalty tiers", "count", n)
+		}
+		return err
+	})
+
+	// удаление событий пользователей, устаревших для переподключения по Last-Event-ID
+	go jobs.Every(ctx, time.Duration(cfgApp.EventsCleanupInterval)*time.Second, "events cleanup", zLog, func(ctx context.Context) error {
+		n, err := repo.DeleteEventsBefore(ctx, time.Duration(cfgApp.EventsTTL)*time.Hour)
+		if n > 0 {
+			zLog.Infow("deleted stale user events", "count", n)
+		}
+		return err
+	})
+
+	// возврат в очередь заказов, захваченных остановившимися экземплярами сервиса
+	go jobs.Every(ctx, time.Duration(cfgApp.AccrualReapInterval)*time.Second, "accrual claims reaper", zLog, func(ctx context.Context) error {
+		n, err := repo.ReleaseExpiredClaims(ctx)
+		if n > 0 {
+			zLog.Infow("released expired accrual claims", "count", n)
+		}
+		return err
+	})
+
+	// ночная сверка балансов
+	if cfgApp.ReconcileInterval > 0 {
+		go jobs.Every(ctx, time.Duration(cfgApp.ReconcileInterval)*time.Second, "balance reconciliation", zLog, func(ctx context.Context) error {
+			_, err := reconcile.Run(ctx, repo, cfgApp.ReconcileRepair, zLog)
+			return err
+		})
+	}
 
 	// accrual pool
-	accrualPool := accrual.New(ctx, repo, cfgApp, zLog)
+	accrualPool, err := accrual.New(ctx, repo, cfgApp, zLog)
+	if err != nil {
+		zLog.Fatal(err)
+	}
 	defer accrualPool.Close()
 
-	r := handlers.NewRouter(repo, cfgApp)
+	// события пользователей (SSE) через Postgres LISTEN/NOTIFY
+	broker := events.NewBroker(zLog)
+	go broker.Run(ctx, repo)
+
+	// доставка вебхуков партнерам из outbox
+	dispatcher := webhooks.New(repo, cfgApp, zLog)
+	go dispatcher.Run(ctx)
+
+	r := handlers.NewRouter(repo, cfgApp, broker, accrualPool)
 	httpServer := &http.Server{
 		Addr:        cfgApp.RunAddress,
 		Handler:     r,
@@ -84,3 +163,44 @@ func Run() {
 		zLog.Infow("web server gracefully stopped")
 	}
 }
+
+// Reconcile - подкоманда reconcile: однократная сверка балансов с отчетом в stdout (JSON).
+// С флагом -repair расхождения исправляются. Возвращает код выхода: 1 - остались неисправленные расхождения
+func Reconcile() int {
+	zLog, err := logger.NewStderr(1)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer zLog.Sync()
+
+	cfgApp, err := cfg.New()
+	if err != nil {
+		zLog.Fatal(err)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	dbPool, err := repository.NewDB(ctx, cfgApp.DatabaseURI, zLog, false)
+	if err != nil {
+		zLog.Fatal(err)
+	}
+	defer dbPool.Close()
+
+	report, err := reconcile.Run(ctx, &dbPool, cfgApp.ReconcileRepair, zLog)
+	if err != nil {
+		zLog.Errorw("balance reconciliation failed", "error", err)
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(report); err != nil {
+		zLog.Errorw("can't write report", "error", err)
+		return 2
+	}
+	if len(report.Mismatches) > report.Repaired {
+		return 1
+	}
+	return 0
+}
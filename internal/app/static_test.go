@@ -6,11 +6,15 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/events"
 	"github.com/antonevtu/go-musthave-diploma/internal/handlers"
 	"github.com/antonevtu/go-musthave-diploma/internal/logger"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
 	"github.com/antonevtu/go-musthave-diploma/internal/repository"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
@@ -18,11 +22,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type registerT struct {
-	Login    string `json:"login"`
-	Password string `json:"password"`
+	Login        string `json:"login"`
+	Password     string `json:"password"`
+	ReferralCode string `json:"referral_code,omitempty"`
 }
 
 type withdrawal struct {
@@ -74,7 +80,7 @@ func TestStatic(t *testing.T) {
 	//require.NoError(t, err)
 
 	// тестовый сервер
-	r := handlers.NewRouter(&db, cfgApp)
+	r := handlers.NewRouter(&db, cfgApp, events.NewBroker(zLog), nil)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
@@ -250,6 +256,32 @@ func TestStatic(t *testing.T) {
 	require.NoError(t, err)
 	resp.Body.Close()
 
+	// получение заказа с историей статусов (200)
+	client = &http.Client{}
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/user/orders/"+string(order), nil)
+	require.NoError(t, err)
+	req.AddCookie(cookiesTrue1[0])
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	respBody, err = ioutil.ReadAll(resp.Body)
+	fmt.Println(string(respBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// получение чужого заказа (404)
+	client = &http.Client{}
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/user/orders/"+string(order), nil)
+	require.NoError(t, err)
+	req.AddCookie(cookiesTrue2[0])
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 404, resp.StatusCode)
+	respBody, err = ioutil.ReadAll(resp.Body)
+	fmt.Println(string(respBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+
 	// получение списка загруженных номеров заказов пользователя 2 (204 - нет контента)
 	client = &http.Client{}
 	req, err = http.NewRequest(http.MethodGet, ts.URL+"/api/user/orders", bytes.NewBuffer([]byte("")))
@@ -299,6 +331,48 @@ func TestStatic(t *testing.T) {
 	require.NoError(t, err)
 	resp.Body.Close()
 
+	// повторный запрос на списание с ключом идемпотентности (сохраненный ответ 200)
+	with = withdrawal{
+		Order: "2377225624",
+		Sum:   10,
+	}
+	withJS, _ = json.Marshal(with)
+	idempotencyKey := uuid.NewString()
+
+	for i := 0; i < 2; i++ {
+		client = &http.Client{}
+		req, err = http.NewRequest(http.MethodPost, ts.URL+"/api/user/balance/withdraw", bytes.NewBuffer(withJS))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+		require.NoError(t, err)
+		req.AddCookie(cookiesTrue1[0])
+		resp, err = client.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+		respBody, err = ioutil.ReadAll(resp.Body)
+		fmt.Println(string(respBody))
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// тот же ключ идемпотентности с другим телом запроса (409)
+	with.Sum = 20
+	withJS, _ = json.Marshal(with)
+
+	client = &http.Client{}
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/api/user/balance/withdraw", bytes.NewBuffer(withJS))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", idempotencyKey)
+	require.NoError(t, err)
+	req.AddCookie(cookiesTrue1[0])
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, 409, resp.StatusCode)
+	respBody, err = ioutil.ReadAll(resp.Body)
+	fmt.Println(string(respBody))
+	require.NoError(t, err)
+	resp.Body.Close()
+
 	// запрос на списание средств (недостаточно средств 402)
 	with = withdrawal{
 		Order: "5404368922619749",
@@ -345,3 +419,542 @@ func TestStatic(t *testing.T) {
 	require.NoError(t, err)
 	resp.Body.Close()
 }
+
+const testAdminToken = "admin-token"
+
+// testUser - зарегистрированный через API пользователь
+type testUser struct {
+	id     int
+	login  string
+	cookie *http.Cookie
+}
+
+// testConfig - конфигурация тестового сервера из флагов теста
+func testConfig() cfg.Config {
+	return cfg.Config{
+		DatabaseURI:         *DatabaseURI,
+		SecretKey:           *SecretKey,
+		TokenPeriodExpire:   *TokenPeriodExpire,
+		CtxTimeout:          *CtxTimeout,
+		IdempotencyKeyTTL:   24,
+		IdempotencyKeyLease: 60,
+		HoldTTL:             900,
+		AdminToken:          testAdminToken,
+	}
+}
+
+// testServer поднимает тестовый сервер на чистой локальной БД (флаг -d) с настройками
+// репозитория из cfgApp, как при запуске сервиса. Без БД тест пропускается
+func testServer(t *testing.T, cfgApp cfg.Config) (*repository.DBT, *httptest.Server) {
+	if *DatabaseURI == "" {
+		t.Skip("postgres url is not set (-d)")
+	}
+	zLog, err := logger.New(0)
+	require.NoError(t, err)
+
+	db, err := repository.NewDB(context.Background(), *DatabaseURI, zLog, true)
+	require.NoError(t, err)
+	db.SetPointsLifetime(cfgApp.PointsLifetimeMonths)
+	db.SetReferralBonus(repository.ReferralBonus{Referrer: cfgApp.ReferrerBonus, Referred: cfgApp.ReferredBonus})
+	db.SetWithdrawalLimits(repository.WithdrawalLimits{
+		MaxPerWithdrawal: cfgApp.WithdrawMax,
+		Daily:            cfgApp.WithdrawDailyLimit,
+		Weekly:           cfgApp.WithdrawWeeklyLimit,
+		MinAccountAge:    cfgApp.WithdrawMinAccountAge,
+		MaxOrderShare:    cfgApp.WithdrawMaxOrderShare,
+	})
+
+	ts := httptest.NewServer(handlers.NewRouter(&db, cfgApp, events.NewBroker(zLog), nil))
+	t.Cleanup(func() {
+		ts.Close()
+		db.Close()
+	})
+	return &db, ts
+}
+
+// doRequest отправляет запрос тестовому серверу: []byte - как text/plain, остальное - как JSON
+func doRequest(t *testing.T, ts *httptest.Server, method, path string, body interface{}, prepare func(req *http.Request)) (*http.Response, []byte) {
+	var buf []byte
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		buf = b
+		contentType = "text/plain"
+	default:
+		var err error
+		buf, err = json.Marshal(b)
+		require.NoError(t, err)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, bytes.NewBuffer(buf))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	if prepare != nil {
+		prepare(req)
+	}
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	return resp, respBody
+}
+
+// userRequest - запрос от имени пользователя, возвращает код ответа и тело
+func userRequest(t *testing.T, ts *httptest.Server, u testUser, method, path string, body interface{}) (int, []byte) {
+	resp, respBody := doRequest(t, ts, method, path, body, func(req *http.Request) {
+		req.AddCookie(u.cookie)
+	})
+	return resp.StatusCode, respBody
+}
+
+// adminRequest - запрос к административному API
+func adminRequest(t *testing.T, ts *httptest.Server, method, path string, body interface{}) (int, []byte) {
+	resp, respBody := doRequest(t, ts, method, path, body, func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	})
+	return resp.StatusCode, respBody
+}
+
+// registerUser регистрирует пользователя, при непустом referralCode - по приглашению
+func registerUser(t *testing.T, ts *httptest.Server, db *repository.DBT, referralCode string) testUser {
+	user := registerT{Login: uuid.NewString(), Password: uuid.NewString(), ReferralCode: referralCode}
+	resp, _ := doRequest(t, ts, http.MethodPost, "/api/user/register", user, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	cookies := resp.Cookies()
+	require.NotEmpty(t, cookies)
+
+	lu, err := db.Login(context.Background(), user.Login)
+	require.NoError(t, err)
+	return testUser{id: lu.UserID, login: user.Login, cookie: cookies[0]}
+}
+
+// accrue загружает заказ пользователя и проводит его через очередь опроса с начислением amount
+func accrue(t *testing.T, db *repository.DBT, userID int, amount points.Amount) string {
+	ctx := context.Background()
+	order := goluhn.Generate(16)
+	require.NoError(t, db.PostOrder(ctx, userID, order))
+	items, err := db.ClaimBatch(ctx, 1, "test", time.Minute)
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	require.Equal(t, order, items[0].Order)
+	require.NoError(t, db.FinalizeOrder(ctx, "test", order, repository.AccrualProcessed, amount, nil))
+	return order
+}
+
+// getUserBalance - баланс пользователя через API
+func getUserBalance(t *testing.T, ts *httptest.Server, u testUser) repository.Balance {
+	status, body := userRequest(t, ts, u, http.MethodGet, "/api/user/balance", nil)
+	require.Equal(t, http.StatusOK, status)
+	b := repository.Balance{}
+	require.NoError(t, json.Unmarshal(body, &b))
+	return b
+}
+
+// pts - количество баллов из десятичной записи
+func pts(t *testing.T, s string) points.Amount {
+	a, err := points.Parse(s)
+	require.NoError(t, err)
+	return a
+}
+
+// TestLedger - журнал баллов: выписка сходится с балансом, сверка без расхождений
+func TestLedger(t *testing.T) {
+	db, ts := testServer(t, testConfig())
+	ctx := context.Background()
+	user := registerUser(t, ts, db, "")
+
+	accrue(t, db, user.id, pts(t, "100"))
+	status, body := userRequest(t, ts, user, http.MethodPost, "/api/user/balance/withdraw", withdrawal{Order: goluhn.Generate(16), Sum: 30})
+	require.Equal(t, http.StatusOK, status, string(body))
+
+	// выписка с открытия счета: начисление и списание (200)
+	status, body = userRequest(t, ts, user, http.MethodGet, "/api/user/balance/statement", nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	st := repository.Statement{}
+	require.NoError(t, json.Unmarshal(body, &st))
+	assert.Equal(t, points.Amount(0), st.Opening)
+	assert.Equal(t, pts(t, "70"), st.Closing)
+	require.Len(t, st.Entries, 2)
+	assert.Equal(t, pts(t, "100"), st.Entries[0].Amount)
+	assert.Equal(t, pts(t, "-30"), st.Entries[1].Amount)
+
+	b := getUserBalance(t, ts, user)
+	assert.Equal(t, st.Closing, b.Current)
+	assert.Equal(t, pts(t, "30"), b.Withdrawn)
+
+	report, err := db.Reconcile(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Mismatches)
+
+	// неверный период выписки (400)
+	status, _ = userRequest(t, ts, user, http.MethodGet, "/api/user/balance/statement?from=yesterday", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = userRequest(t, ts, user, http.MethodGet, "/api/user/balance/statement?from=2030-01-02&to=2030-01-01", nil)
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+// TestTransfers - переводы баллов: срок жизни переданных баллов, отказы, встречные переводы
+func TestTransfers(t *testing.T) {
+	db, ts := testServer(t, testConfig())
+	sender := registerUser(t, ts, db, "")
+	recipient := registerUser(t, ts, db, "")
+
+	// баллы отправителя сгорают через месяц; срок жизни новых начислений дольше
+	db.SetPointsLifetime(1)
+	accrue(t, db, sender.id, pts(t, "100"))
+	db.SetPointsLifetime(12)
+	accrue(t, db, recipient.id, pts(t, "100"))
+
+	// перевод (200): получатель получает баллы со сроком жизни отправителя
+	status, body := userRequest(t, ts, sender, http.MethodPost, "/api/user/balance/transfer",
+		map[string]interface{}{"login": recipient.login, "amount": 30})
+	require.Equal(t, http.StatusOK, status, string(body))
+	item := repository.TransferItem{}
+	require.NoError(t, json.Unmarshal(body, &item))
+	assert.Equal(t, pts(t, "30"), item.Amount)
+
+	sb := getUserBalance(t, ts, sender)
+	assert.Equal(t, pts(t, "70"), sb.Current)
+	require.Len(t, sb.Expiring, 1)
+	rb := getUserBalance(t, ts, recipient)
+	assert.Equal(t, pts(t, "130"), rb.Current)
+	require.Len(t, rb.Expiring, 2)
+	assert.Equal(t, repository.Expiration{Amount: pts(t, "30"), At: sb.Expiring[0].At}, rb.Expiring[0])
+
+	// недостаточно баллов (402)
+	status, _ = userRequest(t, ts, sender, http.MethodPost, "/api/user/balance/transfer",
+		map[string]interface{}{"login": recipient.login, "amount": 1000})
+	assert.Equal(t, http.StatusPaymentRequired, status)
+
+	// перевод самому себе (400)
+	status, _ = userRequest(t, ts, sender, http.MethodPost, "/api/user/balance/transfer",
+		map[string]interface{}{"login": sender.login, "amount": 1})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// неизвестный получатель (404)
+	status, _ = userRequest(t, ts, sender, http.MethodPost, "/api/user/balance/transfer",
+		map[string]interface{}{"login": uuid.NewString(), "amount": 1})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// встречные переводы одновременно: строки балансов блокируются в одном порядке, взаимной блокировки нет
+	const n = 10
+	statuses := make(chan int, 2*n)
+	for i := 0; i < n; i++ {
+		for _, pair := range [][2]testUser{{sender, recipient}, {recipient, sender}} {
+			// require нельзя вызывать вне горутины теста: ошибка запроса передается кодом 0
+			go func(from, to testUser) {
+				js, _ := json.Marshal(map[string]interface{}{"login": to.login, "amount": 1})
+				req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/user/balance/transfer", bytes.NewBuffer(js))
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				req.Header.Set("Content-Type", "application/json")
+				req.AddCookie(from.cookie)
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}(pair[0], pair[1])
+		}
+	}
+	for i := 0; i < 2*n; i++ {
+		assert.Equal(t, http.StatusOK, <-statuses)
+	}
+	assert.Equal(t, pts(t, "70"), getUserBalance(t, ts, sender).Current)
+	assert.Equal(t, pts(t, "130"), getUserBalance(t, ts, recipient).Current)
+}
+
+// TestRefunds - возврат баллов по списанию в исходные партии с их сроком жизни
+func TestRefunds(t *testing.T) {
+	db, ts := testServer(t, testConfig())
+	user := registerUser(t, ts, db, "")
+
+	db.SetPointsLifetime(1)
+	accrue(t, db, user.id, pts(t, "100"))
+	db.SetPointsLifetime(12)
+	before := getUserBalance(t, ts, user)
+	require.Len(t, before.Expiring, 1)
+
+	order := goluhn.Generate(16)
+	status, body := userRequest(t, ts, user, http.MethodPost, "/api/user/balance/withdraw", withdrawal{Order: order, Sum: 40})
+	require.Equal(t, http.StatusOK, status, string(body))
+
+	// частичный и полный возврат (201): баллы возвращаются в партию начисления, а не новой партией
+	status, body = adminRequest(t, ts, http.MethodPost, "/api/admin/withdrawals/"+order+"/refunds",
+		map[string]interface{}{"sum": 15, "reason": "partial return"})
+	require.Equal(t, http.StatusCreated, status, string(body))
+	status, body = adminRequest(t, ts, http.MethodPost, "/api/admin/withdrawals/"+order+"/refunds",
+		map[string]interface{}{"sum": 25, "reason": "order cancelled"})
+	require.Equal(t, http.StatusCreated, status, string(body))
+
+	after := getUserBalance(t, ts, user)
+	assert.Equal(t, pts(t, "100"), after.Current)
+	assert.Equal(t, points.Amount(0), after.Withdrawn)
+	assert.Equal(t, before.Expiring, after.Expiring)
+
+	// возврат сверх списанного (409)
+	status, _ = adminRequest(t, ts, http.MethodPost, "/api/admin/withdrawals/"+order+"/refunds",
+		map[string]interface{}{"sum": 1, "reason": "again"})
+	assert.Equal(t, http.StatusConflict, status)
+
+	// неизвестное списание (404)
+	status, _ = adminRequest(t, ts, http.MethodPost, "/api/admin/withdrawals/"+goluhn.Generate(16)+"/refunds",
+		map[string]interface{}{"sum": 1, "reason": "unknown"})
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+// TestHolds - резервы баллов: списание, отмена, истечение срока, занятый номер заказа
+func TestHolds(t *testing.T) {
+	db, ts := testServer(t, testConfig())
+	ctx := context.Background()
+	user := registerUser(t, ts, db, "")
+	other := registerUser(t, ts, db, "")
+	accrue(t, db, user.id, pts(t, "100"))
+
+	createHold := func(order string, sum float64) (int, repository.Hold) {
+		status, body := userRequest(t, ts, user, http.MethodPost, "/api/user/balance/holds", withdrawal{Order: order, Sum: sum})
+		h := repository.Hold{}
+		if status == http.StatusCreated {
+			require.NoError(t, json.Unmarshal(body, &h))
+		}
+		return status, h
+	}
+	holdAction := func(h repository.Hold, action string) int {
+		status, _ := userRequest(t, ts, user, http.MethodPost, fmt.Sprintf("/api/user/balance/holds/%d/%s", h.ID, action), nil)
+		return status
+	}
+
+	// резерв (201) и списание (200)
+	order := goluhn.Generate(16)
+	status, captured := createHold(order, 30)
+	require.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, repository.HoldActive, captured.Status)
+	b := getUserBalance(t, ts, user)
+	assert.Equal(t, pts(t, "70"), b.Current)
+	assert.Equal(t, pts(t, "30"), b.Held)
+
+	// номер зарезервированного заказа занят: загрузка другим пользователем (409), повторный резерв (422)
+	status, _ = userRequest(t, ts, other, http.MethodPost, "/api/user/orders", []byte(order))
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = createHold(order, 10)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	require.Equal(t, http.StatusOK, holdAction(captured, "capture"))
+	b = getUserBalance(t, ts, user)
+	assert.Equal(t, pts(t, "70"), b.Current)
+	assert.Equal(t, pts(t, "30"), b.Withdrawn)
+	assert.Equal(t, points.Amount(0), b.Held)
+
+	// повторное списание и отмена списанного резерва (409), чужой резерв (404)
+	assert.Equal(t, http.StatusConflict, holdAction(captured, "capture"))
+	assert.Equal(t, http.StatusConflict, holdAction(captured, "void"))
+	status, _ = userRequest(t, ts, other, http.MethodPost, fmt.Sprintf("/api/user/balance/holds/%d/capture", captured.ID), nil)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// резерв больше баланса (402), отмена резерва возвращает баллы (200)
+	status, _ = createHold(goluhn.Generate(16), 1000)
+	assert.Equal(t, http.StatusPaymentRequired, status)
+	status, voided := createHold(goluhn.Generate(16), 20)
+	require.Equal(t, http.StatusCreated, status)
+	require.Equal(t, http.StatusOK, holdAction(voided, "void"))
+	b = getUserBalance(t, ts, user)
+	assert.Equal(t, pts(t, "70"), b.Current)
+	assert.Equal(t, points.Amount(0), b.Held)
+
+	// резерв с истекшим сроком не списывается (409) и снимается с возвратом баллов
+	expired, err := db.CreateHold(ctx, user.id, goluhn.Generate(16), pts(t, "20"), 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, pts(t, "50"), getUserBalance(t, ts, user).Current)
+	assert.Equal(t, http.StatusConflict, holdAction(expired, "capture"))
+	n, err := db.ExpireHolds(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	b = getUserBalance(t, ts, user)
+	assert.Equal(t, pts(t, "70"), b.Current)
+	assert.Equal(t, points.Amount(0), b.Held)
+
+	report, err := db.Reconcile(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Mismatches)
+}
+
+// TestWithdrawalLimits - ограничения списаний: на одно списание, за сутки, доля суммы заказа
+func TestWithdrawalLimits(t *testing.T) {
+	cfgApp := testConfig()
+	cfgApp.WithdrawMax = pts(t, "50")
+	cfgApp.WithdrawDailyLimit = pts(t, "80")
+	cfgApp.WithdrawMaxOrderShare = 50
+	db, ts := testServer(t, cfgApp)
+	user := registerUser(t, ts, db, "")
+	accrue(t, db, user.id, pts(t, "200"))
+
+	withdraw := func(sum, total float64) (int, string) {
+		status, body := userRequest(t, ts, user, http.MethodPost, "/api/user/balance/withdraw",
+			map[string]interface{}{"order": goluhn.Generate(16), "sum": sum, "order_total": total})
+		return status, string(body)
+	}
+
+	// в пределах ограничений (200)
+	status, body := withdraw(50, 100)
+	require.Equal(t, http.StatusOK, status, body)
+
+	// больше максимума на одно списание (403)
+	status, body = withdraw(60, 200)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, repository.RuleMaxPerWithdrawal)
+
+	// больше доли суммы заказа (403), сумма заказа не указана (400)
+	status, body = withdraw(20, 30)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, repository.RuleMaxOrderShare)
+	status, _ = withdraw(20, 0)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// сверх суточного лимита с учетом списания выше (403)
+	status, body = withdraw(40, 100)
+	assert.Equal(t, http.StatusForbidden, status)
+	assert.Contains(t, body, repository.RuleDailyLimit)
+
+	// нулевая сумма (422)
+	status, _ = withdraw(0, 100)
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+
+	b := getUserBalance(t, ts, user)
+	assert.Equal(t, pts(t, "150"), b.Current)
+	assert.Equal(t, pts(t, "50"), b.Withdrawn)
+}
+
+// TestCampaigns - промо-кампании: десятичный коэффициент, бонус к начислению, отказ в неверном коэффициенте
+func TestCampaigns(t *testing.T) {
+	db, ts := testServer(t, testConfig())
+	user := registerUser(t, ts, db, "")
+
+	campaign := func(multiplier interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"name":       "double week",
+			"starts_at":  time.Now().Add(-24 * time.Hour),
+			"ends_at":    time.Now().Add(24 * time.Hour),
+			"user_ids":   []int{user.id},
+			"multiplier": multiplier,
+		}
+	}
+
+	// создание кампании (201): коэффициент возвращается десятичной записью
+	status, body := adminRequest(t, ts, http.MethodPost, "/api/admin/campaigns", campaign(json.Number("1.5")))
+	require.Equal(t, http.StatusCreated, status, string(body))
+	c := repository.Campaign{}
+	require.NoError(t, json.Unmarshal(body, &c))
+	assert.Equal(t, "1.5", c.Multiplier)
+	assert.True(t, c.Active)
+
+	// дробь, экспонента и коэффициент меньше 1 (400)
+	for _, m := range []interface{}{"3/2", json.Number("15e-1"), json.Number("0.5")} {
+		status, _ = adminRequest(t, ts, http.MethodPost, "/api/admin/campaigns", campaign(m))
+		assert.Equal(t, http.StatusBadRequest, status, m)
+	}
+
+	// начисление за заказ в окне кампании получает бонус 100 * (1.5 - 1)
+	order := accrue(t, db, user.id, pts(t, "100"))
+	assert.Equal(t, pts(t, "150"), getUserBalance(t, ts, user).Current)
+
+	status, body = adminRequest(t, ts, http.MethodGet, fmt.Sprintf("/api/admin/campaigns/%d/awards", c.ID), nil)
+	require.Equal(t, http.StatusOK, status, string(body))
+	var awards []repository.CampaignAward
+	require.NoError(t, json.Unmarshal(body, &awards))
+	require.Len(t, awards, 1)
+	assert.Equal(t, order, awards[0].Order)
+	assert.Equal(t, pts(t, "50"), awards[0].Amount)
+}
+
+// TestReferrals - бонусы за приглашение после первого обработанного заказа приглашенного
+func TestReferrals(t *testing.T) {
+	cfgApp := testConfig()
+	cfgApp.ReferrerBonus = pts(t, "100")
+	cfgApp.ReferredBonus = pts(t, "50")
+	db, ts := testServer(t, cfgApp)
+	referrer := registerUser(t, ts, db, "")
+
+	referrals := func() repository.ReferralStats {
+		status, body := userRequest(t, ts, referrer, http.MethodGet, "/api/user/referrals", nil)
+		require.Equal(t, http.StatusOK, status, string(body))
+		s := repository.ReferralStats{}
+		require.NoError(t, json.Unmarshal(body, &s))
+		return s
+	}
+	stats := referrals()
+	require.NotEmpty(t, stats.Code)
+
+	// регистрация с неизвестным кодом приглашения (400)
+	resp, _ := doRequest(t, ts, http.MethodPost, "/api/user/register",
+		registerT{Login: uuid.NewString(), Password: uuid.NewString(), ReferralCode: "unknown-code"}, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// до обработки заказа приглашенного бонусов нет
+	referred := registerUser(t, ts, db, stats.Code)
+	stats = referrals()
+	assert.Equal(t, 1, stats.Invited)
+	assert.Equal(t, 0, stats.Rewarded)
+	assert.Equal(t, points.Amount(0), getUserBalance(t, ts, referrer).Current)
+
+	// первый обработанный заказ: бонусы обоим, второй заказ бонусов не дает
+	accrue(t, db, referred.id, pts(t, "10"))
+	accrue(t, db, referred.id, pts(t, "10"))
+	assert.Equal(t, pts(t, "100"), getUserBalance(t, ts, referrer).Current)
+	assert.Equal(t, pts(t, "70"), getUserBalance(t, ts, referred).Current)
+
+	stats = referrals()
+	assert.Equal(t, 1, stats.Rewarded)
+	assert.Equal(t, pts(t, "100"), stats.Earned)
+	require.Len(t, stats.Referrals, 1)
+	assert.Equal(t, pts(t, "100"), stats.Referrals[0].Bonus)
+}
+
+// TestReconcile - сверка находит расхождение кэша баланса с журналом и исправляет его
+func TestReconcile(t *testing.T) {
+	db, ts := testServer(t, testConfig())
+	ctx := context.Background()
+	user := registerUser(t, ts, db, "")
+	accrue(t, db, user.id, pts(t, "100"))
+
+	report, err := db.Reconcile(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Mismatches)
+
+	// кэш баланса расходится с журналом: изменение в обход репозитория
+	pool, err := pgxpool.Connect(ctx, *DatabaseURI)
+	require.NoError(t, err)
+	defer pool.Close()
+	_, err = pool.Exec(ctx, "update balance set available = available + 5 where user_id = $1;", user.id)
+	require.NoError(t, err)
+
+	// без исправления расхождение только в отчете
+	report, err = db.Reconcile(ctx, false)
+	require.NoError(t, err)
+	require.Len(t, report.Mismatches, 1)
+	m := report.Mismatches[0]
+	assert.Equal(t, repository.MismatchAvailable, m.Kind)
+	assert.Equal(t, user.id, m.UserID)
+	assert.Equal(t, pts(t, "100"), m.Expected)
+	assert.Equal(t, pts(t, "105"), m.Actual)
+	assert.False(t, m.Repaired)
+	assert.Equal(t, pts(t, "105"), getUserBalance(t, ts, user).Current)
+
+	// с исправлением кэш берется из журнала, повторная сверка чистая
+	report, err = db.Reconcile(ctx, true)
+	require.NoError(t, err)
+	require.Len(t, report.Mismatches, 1)
+	assert.True(t, report.Mismatches[0].Repaired)
+	assert.Equal(t, 1, report.Repaired)
+	assert.Equal(t, pts(t, "100"), getUserBalance(t, ts, user).Current)
+
+	report, err = db.Reconcile(ctx, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Mismatches)
+}
@@ -3,6 +3,8 @@ package cfg
 import (
 	"flag"
 	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/tiers"
 	"github.com/caarlos0/env/v6"
 	"strconv"
 )
@@ -15,7 +17,90 @@ type Config struct {
 	SecretKey         string `env:"SECRET_KEY" envDefault:"secret_key"`
 	TokenPeriodExpire int64  `env:"TOKEN_PERIOD_EXPIRE" envDefault:"240"`
 
+	// ограничение времени запроса к системе начислений, в миллисекундах
 	CtxTimeout int64 `env:"CTX_TIMEOUT" envDefault:"500"`
+
+	// пул опроса системы начислений: количество воркеров, глубина канала заказов,
+	// ожидание при пустой очереди в миллисекундах (растет от min до max)
+	AccrualWorkers    int   `env:"ACCRUAL_WORKERS" envDefault:"4"`
+	AccrualQueueDepth int   `env:"ACCRUAL_QUEUE_DEPTH" envDefault:"1"`
+	AccrualPollMin    int64 `env:"ACCRUAL_POLL_MIN" envDefault:"100"`
+	AccrualPollMax    int64 `env:"ACCRUAL_POLL_MAX" envDefault:"5000"`
+	// начальный лимит запросов к системе начислений в минуту (0 - без ограничения),
+	// уточняется по ответам 429
+	AccrualRateLimit int `env:"ACCRUAL_RATE_LIMIT" envDefault:"0"`
+	// повторы опроса заказа: задержки в секундах растут экспоненциально от base до max (со случайным
+	// разбросом), после max-attempts попыток заказ уходит в dead letter (0 - попытки не ограничены)
+	AccrualMaxAttempts int   `env:"ACCRUAL_MAX_ATTEMPTS" envDefault:"20"`
+	AccrualRetryBase   int64 `env:"ACCRUAL_RETRY_BASE" envDefault:"1"`
+	AccrualRetryMax    int64 `env:"ACCRUAL_RETRY_MAX" envDefault:"600"`
+	// автоматический выключатель: размыкается после threshold ошибок системы начислений подряд
+	// (0 - не размыкается) на cooldown секунд
+	AccrualBreakerThreshold int   `env:"ACCRUAL_BREAKER_THRESHOLD" envDefault:"5"`
+	AccrualBreakerCooldown  int64 `env:"ACCRUAL_BREAKER_COOLDOWN" envDefault:"30"`
+	// сбоев воркера или producer подряд, после которых пул останавливается (0 - перезапуски не ограничены)
+	AccrualMaxRestarts int `env:"ACCRUAL_MAX_RESTARTS" envDefault:"10"`
+	// срок, на который экземпляр сервиса захватывает заказы из общей очереди, и период возврата
+	// в очередь заказов с истекшим сроком захвата, в секундах (0 - не возвращаются)
+	AccrualLease        int64 `env:"ACCRUAL_LEASE" envDefault:"60"`
+	AccrualReapInterval int64 `env:"ACCRUAL_REAP_INTERVAL" envDefault:"30"`
+	// идентификатор экземпляра сервиса в общей очереди заказов. Пустой - имя хоста и pid
+	InstanceID string `env:"INSTANCE_ID"`
+
+	// срок хранения событий пользователей для переподключения по Last-Event-ID, в часах, и период
+	// удаления устаревших событий в секундах (0 - не удаляются)
+	EventsTTL             int64 `env:"EVENTS_TTL" envDefault:"168"`
+	EventsCleanupInterval int64 `env:"EVENTS_CLEANUP_INTERVAL" envDefault:"3600"`
+
+	// срок хранения ответов на запросы с Idempotency-Key, в часах, и срок резервирования ключа
+	// выполняющимся запросом, в секундах
+	IdempotencyKeyTTL   int64 `env:"IDEMPOTENCY_KEY_TTL" envDefault:"24"`
+	IdempotencyKeyLease int64 `env:"IDEMPOTENCY_KEY_LEASE" envDefault:"60"`
+
+	// срок жизни начисленных баллов в месяцах (0 - не сгорают) и период проверки сгорания в секундах
+	// (0 - проверка не запускается)
+	PointsLifetimeMonths int   `env:"POINTS_LIFETIME_MONTHS" envDefault:"0"`
+	ExpirationInterval   int64 `env:"EXPIRATION_INTERVAL" envDefault:"3600"`
+
+	// уровни программы лояльности по баллам, начисленным за 12 месяцев: имя:порог:коэффициент начислений,
+	// например BRONZE:0:1,SILVER:1000:1.1,GOLD:5000:1.25. Пустое значение - уровни отключены.
+	// Сохраненные уровни пересчитываются с периодом в секундах (0 - не пересчитываются по расписанию)
+	LoyaltyTiers        tiers.Tiers `env:"LOYALTY_TIERS"`
+	TierRefreshInterval int64       `env:"TIER_REFRESH_INTERVAL" envDefault:"3600"`
+
+	// бонусы за приглашение после первого обработанного заказа приглашенного: пригласившему и приглашенному
+	ReferrerBonus points.Amount `env:"REFERRER_BONUS" envDefault:"100"`
+	ReferredBonus points.Amount `env:"REFERRED_BONUS" envDefault:"50"`
+
+	// максимальная сумма переводов баллов пользователя за сутки, 0 - без ограничения
+	TransferDailyLimit points.Amount `env:"TRANSFER_DAILY_LIMIT" envDefault:"0"`
+
+	// ограничения списаний, 0 - ограничение не действует: максимум на одно списание, за сутки и за неделю,
+	// минимальный возраст учетной записи в часах, максимальная доля суммы заказа в процентах
+	WithdrawMax           points.Amount `env:"WITHDRAW_MAX" envDefault:"0"`
+	WithdrawDailyLimit    points.Amount `env:"WITHDRAW_DAILY_LIMIT" envDefault:"0"`
+	WithdrawWeeklyLimit   points.Amount `env:"WITHDRAW_WEEKLY_LIMIT" envDefault:"0"`
+	WithdrawMinAccountAge int64         `env:"WITHDRAW_MIN_ACCOUNT_AGE" envDefault:"0"`
+	WithdrawMaxOrderShare int64         `env:"WITHDRAW_MAX_ORDER_SHARE" envDefault:"0"`
+
+	// срок резервирования баллов под оплату заказа и период снятия просроченных резервов, в секундах
+	// (0 - просроченные резервы не снимаются по расписанию)
+	HoldTTL                int64 `env:"HOLD_TTL" envDefault:"900"`
+	HoldExpirationInterval int64 `env:"HOLD_EXPIRATION_INTERVAL" envDefault:"60"`
+
+	// сверка балансов: период в секундах (0 - не запускается по расписанию) и исправление расхождений
+	ReconcileInterval int64 `env:"RECONCILE_INTERVAL" envDefault:"86400"`
+	ReconcileRepair   bool  `env:"RECONCILE_REPAIR" envDefault:"false"`
+
+	// токен доступа к административному API (Authorization: Bearer <token>). Пустой - API отключено
+	AdminToken string `env:"ADMIN_TOKEN"`
+
+	// вебхуки партнеров: интервалы в миллисекундах, задержки повторов в секундах
+	WebhookMaxAttempts  int   `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"8"`
+	WebhookTimeout      int64 `env:"WEBHOOK_TIMEOUT" envDefault:"5000"`
+	WebhookPollInterval int64 `env:"WEBHOOK_POLL_INTERVAL" envDefault:"1000"`
+	WebhookRetryBase    int64 `env:"WEBHOOK_RETRY_BASE" envDefault:"10"`
+	WebhookRetryMax     int64 `env:"WEBHOOK_RETRY_MAX" envDefault:"3600"`
 }
 
 func New() (Config, error) {
@@ -40,7 +125,7 @@ func New() (Config, error) {
 		cfg.AccrualSystemAddress = flagValue
 		return nil
 	})
-	flag.Func("t", "context timeout in seconds", func(flagValue string) error {
+	flag.Func("t", "context timeout in milliseconds", func(flagValue string) error {
 		t, err := strconv.Atoi(flagValue)
 		if err != nil {
 			return fmt.Errorf("can't parse context timeout -t: %w", err)
@@ -57,6 +142,61 @@ func New() (Config, error) {
 		return nil
 	})
 
+	flag.Func("w", "number of accrual workers", func(flagValue string) error {
+		n, err := strconv.Atoi(flagValue)
+		if err != nil {
+			return fmt.Errorf("can't parse number of accrual workers -w: %w", err)
+		}
+		cfg.AccrualWorkers = n
+		return nil
+	})
+	flag.Func("q", "depth of the accrual orders channel", func(flagValue string) error {
+		n, err := strconv.Atoi(flagValue)
+		if err != nil {
+			return fmt.Errorf("can't parse accrual queue depth -q: %w", err)
+		}
+		cfg.AccrualQueueDepth = n
+		return nil
+	})
+	flag.Func("m", "minimal wait on empty accrual queue in milliseconds", func(flagValue string) error {
+		t, err := strconv.Atoi(flagValue)
+		if err != nil {
+			return fmt.Errorf("can't parse minimal accrual poll wait -m: %w", err)
+		}
+		cfg.AccrualPollMin = int64(t)
+		return nil
+	})
+	flag.Func("x", "maximal wait on empty accrual queue in milliseconds", func(flagValue string) error {
+		t, err := strconv.Atoi(flagValue)
+		if err != nil {
+			return fmt.Errorf("can't parse maximal accrual poll wait -x: %w", err)
+		}
+		cfg.AccrualPollMax = int64(t)
+		return nil
+	})
+	flag.Func("n", "accrual attempts per order before dead letter, 0 - unlimited", func(flagValue string) error {
+		n, err := strconv.Atoi(flagValue)
+		if err != nil {
+			return fmt.Errorf("can't parse accrual max attempts -n: %w", err)
+		}
+		cfg.AccrualMaxAttempts = n
+		return nil
+	})
+
+	flag.Func("points-lifetime", "points lifetime in months, 0 - points never expire", func(flagValue string) error {
+		m, err := strconv.Atoi(flagValue)
+		if err != nil {
+			return fmt.Errorf("can't parse points lifetime: %w", err)
+		}
+		cfg.PointsLifetimeMonths = m
+		return nil
+	})
+	flag.BoolVar(&cfg.ReconcileRepair, "repair", cfg.ReconcileRepair, "repair balance mismatches found by reconciliation")
+	flag.Func("admin-token", "admin API token", func(flagValue string) error {
+		cfg.AdminToken = flagValue
+		return nil
+	})
+
 	flag.Parse()
 
 	return cfg, err
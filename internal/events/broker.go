@@ -0,0 +1,121 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// размер буфера событий одного подписчика. При переполнении подписчик отключается
+// и должен переподключиться с Last-Event-ID
+const subscriberBuffer = 16
+
+const (
+	listenRetryMin = time.Second
+	listenRetryMax = 30 * time.Second
+)
+
+type Listener interface {
+	Listen(ctx context.Context, channel string, fn func(payload string)) error
+}
+
+// Broker раздает события пользователей подписчикам текущего экземпляра сервиса.
+// События приходят из Postgres NOTIFY, поэтому подписчики получают и события,
+// зафиксированные другими экземплярами
+type Broker struct {
+	mu   sync.Mutex
+	subs map[int]map[chan repository.Event]struct{}
+	log  *zap.SugaredLogger
+}
+
+func NewBroker(zapLog *zap.SugaredLogger) *Broker {
+	return &Broker{
+		subs: make(map[int]map[chan repository.Event]struct{}),
+		log:  zapLog,
+	}
+}
+
+// Subscribe возвращает канал событий пользователя и функцию отписки.
+// Канал закрывается при отписке или при переполнении буфера
+func (b *Broker) Subscribe(userID int) (<-chan repository.Event, func()) {
+	ch := make(chan repository.Event, subscriberBuffer)
+
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = make(map[chan repository.Event]struct{})
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.remove(userID, ch)
+	}
+}
+
+func (b *Broker) Publish(e repository.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subs[e.UserID] {
+		select {
+		case ch <- e:
+		default:
+			// медленный клиент - отключаем, он дочитает пропущенное по Last-Event-ID
+			b.log.Infow("sse subscriber is too slow, disconnecting", "userID", e.UserID)
+			b.remove(e.UserID, ch)
+		}
+	}
+}
+
+// remove вызывается под b.mu
+func (b *Broker) remove(userID int, ch chan repository.Event) {
+	if _, ok := b.subs[userID][ch]; !ok {
+		return
+	}
+	delete(b.subs[userID], ch)
+	if len(b.subs[userID]) == 0 {
+		delete(b.subs, userID)
+	}
+	close(ch)
+}
+
+// Run слушает канал уведомлений Postgres до отмены контекста, переподключаясь при ошибках
+func (b *Broker) Run(ctx context.Context, l Listener) {
+	wait := listenRetryMin
+	for {
+		start := time.Now()
+		err := l.Listen(ctx, repository.EventsChannel, b.handleNotification)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > listenRetryMax {
+			wait = listenRetryMin
+		}
+		b.log.Infow("events listener failed, reconnecting", "error", err, "retry_in", wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+		if wait > listenRetryMax {
+			wait = listenRetryMax
+		}
+	}
+}
+
+func (b *Broker) handleNotification(payload string) {
+	e := repository.Event{}
+	err := json.Unmarshal([]byte(payload), &e)
+	if err != nil {
+		b.log.Infow("bad event notification", "payload", payload, "error", err)
+		return
+	}
+	b.Publish(e)
+}
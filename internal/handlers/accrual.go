@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/accrual"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+)
+
+// AccrualPool - управление пулом опроса системы начислений
+type AccrualPool interface {
+	Workers() int
+	SetWorkers(n int) error
+	BreakerState() string
+}
+
+type workersT struct {
+	Workers int `json:"workers"`
+}
+
+func getAccrualWorkers(pool AccrualPool, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pool == nil {
+			http.Error(w, "accrual pool is not running", http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, workersT{Workers: pool.Workers()})
+	}
+}
+
+func setAccrualWorkers(pool AccrualPool, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pool == nil {
+			http.Error(w, "accrual pool is not running", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		req := workersT{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = pool.SetWorkers(req.Workers)
+		if errors.Is(err, accrual.ErrInvalidWorkers) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, http.StatusOK, workersT{Workers: pool.Workers()})
+	}
+}
+
+func getDeadLetters(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := repo.DeadLetters(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func retryDeadLetter(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := repo.RetryDeadLetter(r.Context(), chi.URLParam(r, "order"))
+		if errors.Is(err, repository.ErrDeadLetterNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func discardDeadLetter(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := repo.DiscardDeadLetter(r.Context(), chi.URLParam(r, "order"))
+		if errors.Is(err, repository.ErrDeadLetterNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
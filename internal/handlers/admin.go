@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"net/http"
+	"strings"
+)
+
+// middlewareAdmin пропускает запросы с заголовком Authorization: Bearer <ADMIN_TOKEN>.
+// Если токен не задан в конфигурации, административное API отключено
+func middlewareAdmin(next http.Handler, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfgApp.AdminToken == "" {
+			http.Error(w, "admin api is disabled", http.StatusForbidden)
+			return
+		}
+
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfgApp.AdminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(data)
+}
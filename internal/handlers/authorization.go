@@ -16,13 +16,17 @@ import (
 const minLoginLength = 4
 const maxLoginLength = 64
 const minPasswordLength = 4
-const hashLen = 32 // SHA256
+const hashLen = 32        // SHA256
+const referralCodeLen = 4 // 8 hex-символов
+const referralCodeAttempts = 3
 
 var secretKey = []byte("abc")
 
 type registerT struct {
 	Login    string `json:"login"`
 	Password string `json:"password"`
+	// код приглашения (необязательный, только при регистрации)
+	ReferralCode string `json:"referral_code"`
 }
 
 func register(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
@@ -63,16 +67,35 @@ func register(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 
 			// register in repository
 			reg := repository.RegisterNewUser{
-				Login:   req.Login,
-				PwdHash: pwdHash,
-				PwdSalt: pwdSalt,
-				JWTSalt: JWTSalt,
+				Login:      req.Login,
+				PwdHash:    pwdHash,
+				PwdSalt:    pwdSalt,
+				JWTSalt:    JWTSalt,
+				ReferredBy: strings.TrimSpace(req.ReferralCode),
+			}
+			// код приглашения случайный: при совпадении с кодом другого пользователя генерируется новый
+			var userID int
+			for i := 0; i < referralCodeAttempts; i++ {
+				var referralCode string
+				referralCode, err = auth.RandBytes(referralCodeLen)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				reg.ReferralCode = strings.ToUpper(referralCode)
+				userID, err = repo.Register(r.Context(), reg)
+				if !errors.Is(err, repository.ErrReferralCodeBusy) {
+					break
+				}
 			}
-			userID, err := repo.Register(r.Context(), reg)
 			if errors.Is(err, repository.ErrLoginBusy) {
 				http.Error(w, err.Error(), http.StatusConflict)
 				return
 			}
+			if errors.Is(err, repository.ErrUnknownReferralCode) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
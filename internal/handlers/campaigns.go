@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type campaignT struct {
+	Name        string        `json:"name"`
+	StartsAt    time.Time     `json:"starts_at"`
+	EndsAt      time.Time     `json:"ends_at"`
+	Tier        string        `json:"tier"`
+	UserIDs     []int         `json:"user_ids"`
+	OrderPrefix string        `json:"order_prefix"`
+	Multiplier  json.Number   `json:"multiplier"`
+	Bonus       points.Amount `json:"bonus"`
+	Active      *bool         `json:"active"`
+}
+
+// parseCampaign читает и проверяет описание кампании из тела запроса
+func parseCampaign(r *http.Request, cfgApp cfg.Config) (repository.Campaign, error) {
+	c := repository.Campaign{}
+	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+		return c, errors.New("invalid content-type: must be application/json")
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return c, err
+	}
+	defer r.Body.Close()
+
+	req := campaignT{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		return c, err
+	}
+
+	if req.Name == "" {
+		return c, errors.New("name is required")
+	}
+	if req.StartsAt.IsZero() || !req.EndsAt.After(req.StartsAt) {
+		return c, errors.New("starts_at and ends_at are required, ends_at must be after starts_at")
+	}
+	if req.Multiplier == "" {
+		req.Multiplier = "1"
+	}
+	m, err := points.ParseMultiplier(req.Multiplier.String())
+	if err != nil || m.Cmp(big.NewRat(1, 1)) < 0 {
+		return c, errors.New("multiplier must be a decimal number not less than 1")
+	}
+	if m.Cmp(big.NewRat(1, 1)) == 0 && req.Bonus == 0 {
+		return c, errors.New("campaign must have multiplier greater than 1 or bonus")
+	}
+	if req.Tier != "" {
+		known := false
+		for _, t := range cfgApp.LoyaltyTiers {
+			known = known || t.Name == req.Tier
+		}
+		if !known {
+			return c, fmt.Errorf("unknown tier %q", req.Tier)
+		}
+	}
+
+	c = repository.Campaign{
+		Name:        req.Name,
+		StartsAt:    req.StartsAt,
+		EndsAt:      req.EndsAt,
+		Tier:        req.Tier,
+		UserIDs:     req.UserIDs,
+		OrderPrefix: req.OrderPrefix,
+		Multiplier:  req.Multiplier.String(),
+		Bonus:       req.Bonus,
+		Active:      req.Active == nil || *req.Active,
+	}
+	return c, nil
+}
+
+func addCampaign(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := parseCampaign(r, cfgApp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c, err = repo.AddCampaign(r.Context(), c)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusCreated, c)
+	}
+}
+
+func updateCampaign(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid campaign id", http.StatusBadRequest)
+			return
+		}
+		c, err := parseCampaign(r, cfgApp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.ID = id
+
+		c, err = repo.UpdateCampaign(r.Context(), c)
+		writeCampaignResult(w, c, err)
+	}
+}
+
+func getCampaign(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid campaign id", http.StatusBadRequest)
+			return
+		}
+		c, err := repo.GetCampaign(r.Context(), id)
+		writeCampaignResult(w, c, err)
+	}
+}
+
+func writeCampaignResult(w http.ResponseWriter, c repository.Campaign, err error) {
+	switch {
+	case errors.Is(err, repository.ErrCampaignNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+func getCampaigns(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		campaigns, err := repo.Campaigns(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, campaigns)
+	}
+}
+
+func deleteCampaign(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid campaign id", http.StatusBadRequest)
+			return
+		}
+
+		err = repo.DeactivateCampaign(r.Context(), id)
+		if errors.Is(err, repository.ErrCampaignNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func getCampaignAwards(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid campaign id", http.StatusBadRequest)
+			return
+		}
+
+		awards, err := repo.CampaignAwards(r.Context(), id)
+		if errors.Is(err, repository.ErrCampaignNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, awards)
+	}
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/events"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const sseHeartbeatPeriod = 15 * time.Second
+
+func userEvents(repo Repositorier, broker *events.Broker, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		var lastID int64
+		if s := r.Header.Get("Last-Event-ID"); s != "" {
+			id, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+			lastID = id
+		}
+
+		// подписка до чтения пропущенных событий, чтобы не потерять события между ними
+		userID := r.Context().Value(UserIDKey).(int)
+		ch, unsubscribe := broker.Subscribe(userID)
+		defer unsubscribe()
+
+		missed := []repository.Event{}
+		if lastID > 0 {
+			var err error
+			missed, err = repo.EventsAfter(r.Context(), userID, lastID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+
+		// события, пришедшие по подписке во время чтения истории, отправлены вместе с историей.
+		// Порядок id не совпадает с порядком commit, поэтому пропускаются только отправленные события.
+		// История читается страницами, пока не будет прочитана полностью
+		sent := make(map[int64]struct{}, len(missed))
+		for len(missed) > 0 {
+			for _, e := range missed {
+				if err := writeEvent(w, e); err != nil {
+					return
+				}
+				sent[e.ID] = struct{}{}
+				lastID = e.ID
+			}
+			flusher.Flush()
+
+			var err error
+			missed, err = repo.EventsAfter(r.Context(), userID, lastID)
+			if err != nil {
+				// клиент переподключится и продолжит с последнего полученного события
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(sseHeartbeatPeriod)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e, ok := <-ch:
+				if !ok {
+					return
+				}
+				if _, ok := sent[e.ID]; ok {
+					delete(sent, e.ID)
+					continue
+				}
+				if err := writeEvent(w, e); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, e repository.Event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+	return err
+}
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/accrual"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"net/http"
+)
+
+// состояние сервиса: ok - все компоненты работают, degraded - API доступно,
+// но заказы не обрабатываются (пул опроса остановлен или система начислений недоступна)
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+)
+
+type healthT struct {
+	Status  string         `json:"status"`
+	Accrual *accrualHealth `json:"accrual,omitempty"`
+}
+
+type accrualHealth struct {
+	Workers int    `json:"workers"`
+	Breaker string `json:"breaker"`
+}
+
+func getHealth(pool AccrualPool, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pool == nil {
+			writeJSON(w, http.StatusOK, healthT{Status: healthDegraded})
+			return
+		}
+
+		res := healthT{
+			Status:  healthOK,
+			Accrual: &accrualHealth{Workers: pool.Workers(), Breaker: pool.BreakerState()},
+		}
+		if res.Accrual.Breaker != accrual.BreakerClosed {
+			res.Status = healthDegraded
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/ShiraazMoollatjie/goluhn"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// createHold резервирует баллы под оплату заказа (тело запроса как у списания)
+func createHold(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "invalid content-type: must be application/json", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		req := withdrawal{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Sum <= 0 {
+			http.Error(w, "hold sum must be positive", http.StatusBadRequest)
+			return
+		}
+		err = goluhn.Validate(req.Order)
+		if err != nil {
+			http.Error(w, "luhn validation failed", http.StatusUnprocessableEntity)
+			return
+		}
+
+		userID := r.Context().Value(UserIDKey).(int)
+		h, err := repo.CreateHold(r.Context(), userID, req.Order, req.Sum, req.OrderTotal, cfgApp.HoldTTL)
+		var limitErr *repository.LimitError
+		switch {
+		case errors.As(err, &limitErr):
+			http.Error(w, limitErr.Error(), http.StatusForbidden)
+			return
+		case errors.Is(err, repository.ErrOrderTotalRequired):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, repository.ErrNotEnoughFunds):
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		case errors.Is(err, repository.ErrOrderAlreadyExists):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, h)
+	}
+}
+
+func captureHold(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		holdID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid hold id", http.StatusBadRequest)
+			return
+		}
+
+		userID := r.Context().Value(UserIDKey).(int)
+		h, err := repo.CaptureHold(r.Context(), userID, holdID)
+		if errors.Is(err, repository.ErrOrderAlreadyExists) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeHoldResult(w, h, err)
+	}
+}
+
+func voidHold(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		holdID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid hold id", http.StatusBadRequest)
+			return
+		}
+
+		userID := r.Context().Value(UserIDKey).(int)
+		h, err := repo.VoidHold(r.Context(), userID, holdID)
+		writeHoldResult(w, h, err)
+	}
+}
+
+func writeHoldResult(w http.ResponseWriter, h repository.Hold, err error) {
+	switch {
+	case errors.Is(err, repository.ErrHoldNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, repository.ErrHoldNotActive):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, h)
+	}
+}
+
+func getHolds(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserIDKey).(int)
+		holds, err := repo.GetHolds(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(holds) > 0 {
+			writeJSON(w, http.StatusOK, holds)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
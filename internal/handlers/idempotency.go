@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotentReplayHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+
+	// время на сохранение ответа по ключу после завершения запроса
+	idempotencySaveTimeout = 5 * time.Second
+)
+
+// responseRecorder запоминает ответ обработчика для сохранения по ключу идемпотентности
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// middlewareIdempotency выполняет запрос с заголовком Idempotency-Key не более одного раза для пользователя.
+// Повтор с тем же ключом и телом получает сохраненный ответ, с другим телом - 409.
+// Ответы 5xx не сохраняются, такой запрос можно повторить. Вызывается после middlewareAuth
+func middlewareIdempotency(next http.Handler, repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "idempotency key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Body.Close()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		h := sha256.New()
+		h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+		h.Write(body)
+		requestHash := hex.EncodeToString(h.Sum(nil))
+
+		userID := r.Context().Value(UserIDKey).(int)
+		lease := time.Duration(cfgApp.IdempotencyKeyLease) * time.Second
+		saved, reserved, err := repo.ReserveIdempotencyKey(r.Context(), userID, key, requestHash, lease)
+		if errors.Is(err, repository.ErrIdempotencyKeyMismatch) || errors.Is(err, repository.ErrIdempotencyKeyInProgress) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// повтор запроса - отдаем сохраненный ответ
+		if !reserved {
+			if saved.ContentType != "" {
+				w.Header().Set("Content-Type", saved.ContentType)
+			}
+			w.Header().Set(idempotentReplayHeader, "true")
+			w.WriteHeader(saved.StatusCode)
+			_, _ = w.Write(saved.Body)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// результат запроса уже зафиксирован: ответ сохраняется, даже если клиент отключился
+		ctx, cancel := context.WithTimeout(context.Background(), idempotencySaveTimeout)
+		defer cancel()
+		// ошибки сохранения пишет в лог хранилище: ответ клиенту уже отправлен
+		if rec.status >= http.StatusInternalServerError {
+			_ = repo.ReleaseIdempotencyKey(ctx, userID, key)
+			return
+		}
+		resp := repository.IdempotentResponse{
+			StatusCode:  rec.status,
+			ContentType: w.Header().Get("Content-Type"),
+			Body:        rec.body.Bytes(),
+		}
+		// ключ не освобождается: запрос уже выполнен, повтор до истечения резервирования получит 409
+		ttl := time.Duration(cfgApp.IdempotencyKeyTTL) * time.Hour
+		_ = repo.SaveIdempotentResponse(ctx, userID, key, resp, ttl)
+	}
+}
@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"net/http"
+)
+
+// getProfile отдает профиль пользователя: уровень программы лояльности и прогресс до следующего
+func getProfile(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserIDKey).(int)
+		profile, err := repo.Profile(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, profile)
+	}
+}
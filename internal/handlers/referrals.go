@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"net/http"
+)
+
+// getReferrals отдает код приглашения пользователя и статистику приглашений
+func getReferrals(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserIDKey).(int)
+		stats, err := repo.Referrals(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// refundT - запрос возврата списания. Сумма не указана - возвращается вся не возвращенная часть
+type refundT struct {
+	Sum    points.Amount `json:"sum"`
+	Reason string        `json:"reason"`
+}
+
+func refundWithdrawal(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "invalid content-type: must be application/json", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		req := refundT{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Sum < 0 {
+			http.Error(w, "refund sum must be positive", http.StatusBadRequest)
+			return
+		}
+
+		res, err := repo.RefundWithdrawal(r.Context(), chi.URLParam(r, "order"), req.Sum, req.Reason)
+		switch {
+		case errors.Is(err, repository.ErrWithdrawalNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, repository.ErrAlreadyRefunded), errors.Is(err, repository.ErrRefundExceedsWithdrawal):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, res)
+	}
+}
+
+func getWithdrawalRefunds(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		refunds, err := repo.WithdrawalRefunds(r.Context(), chi.URLParam(r, "order"))
+		if errors.Is(err, repository.ErrWithdrawalNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, refunds)
+	}
+}
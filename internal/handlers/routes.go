@@ -2,10 +2,14 @@ package handlers
 
 import (
 	"context"
+	"expvar"
 	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/events"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
 	"github.com/antonevtu/go-musthave-diploma/internal/repository"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"time"
 )
 
 type Repositorier interface {
@@ -15,12 +19,43 @@ type Repositorier interface {
 	GetTokenKey(ctx context.Context, userID int) (key string, err error)
 	PostOrder(ctx context.Context, userID int, order string) error
 	GetOrders(ctx context.Context, userID int) (repository.OrderList, error)
+	GetOrder(ctx context.Context, userID int, order string) (repository.OrderDetails, error)
 	Balance(ctx context.Context, userID int) (repository.Balance, error)
-	WithdrawToOrder(ctx context.Context, userID int, order string, sum float64) error
+	WithdrawToOrder(ctx context.Context, userID int, order string, sum, orderTotal points.Amount) error
 	GetWithdrawals(ctx context.Context, userID int) (repository.WithdrawalsList, error)
+	Transfer(ctx context.Context, userID int, toLogin string, amount, dailyLimit points.Amount) (repository.TransferItem, error)
+	GetTransfers(ctx context.Context, userID int) (repository.TransfersList, error)
+	CreateHold(ctx context.Context, userID int, order string, sum, orderTotal points.Amount, ttl int64) (repository.Hold, error)
+	CaptureHold(ctx context.Context, userID int, holdID int64) (repository.Hold, error)
+	VoidHold(ctx context.Context, userID int, holdID int64) (repository.Hold, error)
+	GetHolds(ctx context.Context, userID int) ([]repository.Hold, error)
+	Profile(ctx context.Context, userID int) (repository.Profile, error)
+	Referrals(ctx context.Context, userID int) (repository.ReferralStats, error)
+	Statement(ctx context.Context, userID int, from, to time.Time) (repository.Statement, error)
+	AddCampaign(ctx context.Context, c repository.Campaign) (repository.Campaign, error)
+	UpdateCampaign(ctx context.Context, c repository.Campaign) (repository.Campaign, error)
+	DeactivateCampaign(ctx context.Context, id int) error
+	GetCampaign(ctx context.Context, id int) (repository.Campaign, error)
+	Campaigns(ctx context.Context) ([]repository.Campaign, error)
+	CampaignAwards(ctx context.Context, id int) ([]repository.CampaignAward, error)
+	RefundWithdrawal(ctx context.Context, order string, amount points.Amount, reason string) (repository.RefundItem, error)
+	WithdrawalRefunds(ctx context.Context, order string) ([]repository.RefundItem, error)
+	DeadLetters(ctx context.Context) ([]repository.DeadLetter, error)
+	RetryDeadLetter(ctx context.Context, order string) error
+	DiscardDeadLetter(ctx context.Context, order string) error
+	EventsAfter(ctx context.Context, userID int, lastID int64) ([]repository.Event, error)
+
+	ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, lease time.Duration) (repository.IdempotentResponse, bool, error)
+	SaveIdempotentResponse(ctx context.Context, userID int, key string, resp repository.IdempotentResponse, ttl time.Duration) error
+	ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error
+
+	AddWebhookSubscription(ctx context.Context, sub repository.WebhookSubscription) (repository.WebhookSubscription, error)
+	WebhookSubscriptions(ctx context.Context) ([]repository.WebhookSubscription, error)
+	DeactivateWebhookSubscription(ctx context.Context, id int) error
+	WebhookDeliveryLog(ctx context.Context, subscriptionID int) ([]repository.WebhookLogItem, error)
 }
 
-func NewRouter(repo Repositorier, cfgApp cfg.Config) chi.Router {
+func NewRouter(repo Repositorier, cfgApp cfg.Config, broker *events.Broker, pool AccrualPool) chi.Router {
 	// Определяем роутер chi
 	r := chi.NewRouter()
 
@@ -36,13 +71,45 @@ func NewRouter(repo Repositorier, cfgApp cfg.Config) chi.Router {
 
 	// создадим суброутер
 	r.Route("/", func(r chi.Router) {
-		r.Post("/api/user/register", register(repo, cfgApp))                                              // регистрация пользователя
-		r.Post("/api/user/login", login(repo, cfgApp))                                                    // аутентификация пользователя
-		r.Post("/api/user/orders", middlewareAuth(postOrder(repo, cfgApp), repo, cfgApp))                 // загрузка пользователем номера заказа для расчета
-		r.Get("/api/user/orders", middlewareAuth(getOrders(repo, cfgApp), repo, cfgApp))                  // получение списка загруженных пользователем номеров звказов, статусов их обработки и информации о начислениях
-		r.Get("/api/user/balance", middlewareAuth(getBalance(repo, cfgApp), repo, cfgApp))                // получение текущего баланса счета баллов лояльности пользователя
-		r.Post("/api/user/balance/withdraw", middlewareAuth(withdrawToOrder(repo, cfgApp), repo, cfgApp)) // запрос на списание баллов с накопительного счета в счет оплаты нового заказа
-		r.Get("/api/user/withdrawals", middlewareAuth(getWithdrawals(repo, cfgApp), repo, cfgApp))        // получение информации о выводе средств с накопительног осчета пользователем
+		r.Get("/api/health", getHealth(pool, cfgApp))                                                                                          // состояние сервиса и пула опроса системы начислений
+		r.Post("/api/user/register", register(repo, cfgApp))                                                                                   // регистрация пользователя
+		r.Post("/api/user/login", login(repo, cfgApp))                                                                                         // аутентификация пользователя
+		r.Post("/api/user/orders", middlewareAuth(middlewareIdempotency(postOrder(repo, cfgApp), repo, cfgApp), repo, cfgApp))                 // загрузка пользователем номера заказа для расчета
+		r.Get("/api/user/orders", middlewareAuth(getOrders(repo, cfgApp), repo, cfgApp))                                                       // получение списка загруженных пользователем номеров звказов, статусов их обработки и информации о начислениях
+		r.Get("/api/user/orders/{number}", middlewareAuth(getOrder(repo, cfgApp), repo, cfgApp))                                               // заказ пользователя с историей смены статусов
+		r.Get("/api/user/profile", middlewareAuth(getProfile(repo, cfgApp), repo, cfgApp))                                                     // профиль пользователя: уровень программы лояльности
+		r.Get("/api/user/referrals", middlewareAuth(getReferrals(repo, cfgApp), repo, cfgApp))                                                 // код приглашения и статистика приглашений
+		r.Get("/api/user/balance", middlewareAuth(getBalance(repo, cfgApp), repo, cfgApp))                                                     // получение текущего баланса счета баллов лояльности пользователя
+		r.Get("/api/user/balance/statement", middlewareAuth(getStatement(repo, cfgApp), repo, cfgApp))                                         // выписка по счету баллов за период (JSON или CSV)
+		r.Post("/api/user/balance/withdraw", middlewareAuth(middlewareIdempotency(withdrawToOrder(repo, cfgApp), repo, cfgApp), repo, cfgApp)) // запрос на списание баллов с накопительного счета в счет оплаты нового заказа
+		r.Post("/api/user/balance/transfer", middlewareAuth(middlewareIdempotency(transferPoints(repo, cfgApp), repo, cfgApp), repo, cfgApp))  // перевод баллов другому пользователю
+		r.Get("/api/user/balance/transfers", middlewareAuth(getTransfers(repo, cfgApp), repo, cfgApp))                                         // история переводов баллов
+		r.Post("/api/user/balance/holds", middlewareAuth(middlewareIdempotency(createHold(repo, cfgApp), repo, cfgApp), repo, cfgApp))         // резервирование баллов под оплату заказа
+		r.Get("/api/user/balance/holds", middlewareAuth(getHolds(repo, cfgApp), repo, cfgApp))                                                 // список резервов
+		r.Post("/api/user/balance/holds/{id}/capture", middlewareAuth(captureHold(repo, cfgApp), repo, cfgApp))                                // списание зарезервированных баллов
+		r.Post("/api/user/balance/holds/{id}/void", middlewareAuth(voidHold(repo, cfgApp), repo, cfgApp))                                      // отмена резерва
+		r.Get("/api/user/withdrawals", middlewareAuth(getWithdrawals(repo, cfgApp), repo, cfgApp))                                             // получение информации о выводе средств с накопительног осчета пользователем
+		r.Get("/api/user/events", middlewareAuth(userEvents(repo, broker, cfgApp), repo, cfgApp))                                              // поток событий пользователя (text/event-stream)
+
+		// административное API
+		r.Get("/debug/vars", middlewareAdmin(expvar.Handler(), cfgApp))                                                 // метрики (expvar), в том числе сверки балансов
+		r.Post("/api/admin/webhooks", middlewareAdmin(addWebhook(repo, cfgApp), cfgApp))                                // подписка партнера на вебхуки
+		r.Get("/api/admin/webhooks", middlewareAdmin(getWebhooks(repo, cfgApp), cfgApp))                                // список подписок
+		r.Delete("/api/admin/webhooks/{id}", middlewareAdmin(deleteWebhook(repo, cfgApp), cfgApp))                      // отключение подписки
+		r.Get("/api/admin/webhooks/{id}/deliveries", middlewareAdmin(getWebhookDeliveries(repo, cfgApp), cfgApp))       // журнал доставки
+		r.Post("/api/admin/withdrawals/{order}/refunds", middlewareAdmin(refundWithdrawal(repo, cfgApp), cfgApp))       // возврат баллов по списанию
+		r.Get("/api/admin/withdrawals/{order}/refunds", middlewareAdmin(getWithdrawalRefunds(repo, cfgApp), cfgApp))    // история возвратов
+		r.Get("/api/admin/accrual/workers", middlewareAdmin(getAccrualWorkers(pool, cfgApp), cfgApp))                   // количество воркеров опроса системы начислений
+		r.Put("/api/admin/accrual/workers", middlewareAdmin(setAccrualWorkers(pool, cfgApp), cfgApp))                   // изменение количества воркеров
+		r.Get("/api/admin/accrual/dead-letters", middlewareAdmin(getDeadLetters(repo, cfgApp), cfgApp))                 // заказы, исчерпавшие попытки опроса
+		r.Post("/api/admin/accrual/dead-letters/{order}/retry", middlewareAdmin(retryDeadLetter(repo, cfgApp), cfgApp)) // повтор опроса заказа
+		r.Delete("/api/admin/accrual/dead-letters/{order}", middlewareAdmin(discardDeadLetter(repo, cfgApp), cfgApp))   // отказ от опроса, заказ INVALID
+		r.Post("/api/admin/campaigns", middlewareAdmin(addCampaign(repo, cfgApp), cfgApp))                              // создание промо-кампании
+		r.Get("/api/admin/campaigns", middlewareAdmin(getCampaigns(repo, cfgApp), cfgApp))                              // список кампаний
+		r.Get("/api/admin/campaigns/{id}", middlewareAdmin(getCampaign(repo, cfgApp), cfgApp))                          // кампания
+		r.Put("/api/admin/campaigns/{id}", middlewareAdmin(updateCampaign(repo, cfgApp), cfgApp))                       // изменение кампании
+		r.Delete("/api/admin/campaigns/{id}", middlewareAdmin(deleteCampaign(repo, cfgApp), cfgApp))                    // остановка кампании
+		r.Get("/api/admin/campaigns/{id}/awards", middlewareAdmin(getCampaignAwards(repo, cfgApp), cfgApp))             // начисленные бонусы кампании
 	})
 	return r
 }
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// parsePeriodBound разбирает границу периода выписки: RFC3339 или дата YYYY-MM-DD.
+// Дата в конце периода (endOfDay) включается в выписку целиком
+func parsePeriodBound(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil && endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// getStatement отдает выписку по счету баллов в JSON или в CSV (Accept: text/csv).
+// Параметры from и to необязательны: по умолчанию выписка с открытия счета по текущий момент
+func getStatement(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var from time.Time
+		to := time.Now()
+		var err error
+		if s := r.URL.Query().Get("from"); s != "" {
+			from, err = parsePeriodBound(s, false)
+			if err != nil {
+				http.Error(w, "invalid from: must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.URL.Query().Get("to"); s != "" {
+			to, err = parsePeriodBound(s, true)
+			if err != nil {
+				http.Error(w, "invalid to: must be RFC3339 or YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+		if !from.IsZero() && !from.Before(to) {
+			http.Error(w, "from must be before to", http.StatusBadRequest)
+			return
+		}
+
+		userID := r.Context().Value(UserIDKey).(int)
+		st, err := repo.Statement(r.Context(), userID, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if strings.Contains(r.Header.Get("Accept"), "text/csv") {
+			writeStatementCSV(w, st)
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	}
+}
+
+// writeStatementCSV пишет выписку в CSV: входящий остаток, движения, исходящий остаток
+func writeStatementCSV(w http.ResponseWriter, st repository.Statement) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="statement.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	_ = cw.Write([]string{"date", "type", "order", "amount", "balance"})
+	_ = cw.Write([]string{st.From, "opening_balance", "", "", st.Opening.String()})
+	for _, e := range st.Entries {
+		_ = cw.Write([]string{e.Date, e.Type, e.Order, e.Amount.String(), e.Balance.String()})
+	}
+	_ = cw.Write([]string{st.To, "closing_balance", "", "", st.Closing.String()})
+	cw.Flush()
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type transferT struct {
+	Login  string        `json:"login"`
+	Amount points.Amount `json:"amount"`
+}
+
+func transferPoints(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "invalid content-type: must be application/json", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		req := transferT{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Login == "" || req.Amount <= 0 {
+			http.Error(w, "recipient login and positive amount are required", http.StatusBadRequest)
+			return
+		}
+
+		userID := r.Context().Value(UserIDKey).(int)
+		res, err := repo.Transfer(r.Context(), userID, req.Login, req.Amount, cfgApp.TransferDailyLimit)
+		var limitErr *repository.LimitError
+		switch {
+		case errors.Is(err, repository.ErrUnknownLogin):
+			http.Error(w, "unknown recipient", http.StatusNotFound)
+			return
+		case errors.Is(err, repository.ErrSelfTransfer):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, repository.ErrNotEnoughFunds):
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		case errors.As(err, &limitErr):
+			http.Error(w, limitErr.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func getTransfers(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value(UserIDKey).(int)
+		tl, err := repo.GetTransfers(r.Context(), userID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(tl) > 0 {
+			writeJSON(w, http.StatusOK, tl)
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
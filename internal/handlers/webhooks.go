@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/auth"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const webhookSecretLen = 32
+
+type webhookSubscriptionT struct {
+	Partner    string   `json:"partner"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	Secret     string   `json:"secret"`
+}
+
+func addWebhook(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "invalid content-type: must be application/json", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		req := webhookSubscriptionT{}
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if req.Partner == "" {
+			http.Error(w, "partner is required", http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "invalid webhook url", http.StatusBadRequest)
+			return
+		}
+		if len(req.EventTypes) == 0 {
+			http.Error(w, "event_types is required", http.StatusBadRequest)
+			return
+		}
+		for _, t := range req.EventTypes {
+			if t != repository.WebhookOrderProcessed && t != repository.WebhookOrderInvalid {
+				http.Error(w, "unknown event type: "+t, http.StatusBadRequest)
+				return
+			}
+		}
+
+		// секрет подписи генерируется, если партнер не передал свой
+		if req.Secret == "" {
+			req.Secret, err = auth.RandBytes(webhookSecretLen)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		sub, err := repo.AddWebhookSubscription(r.Context(), repository.WebhookSubscription{
+			Partner:    req.Partner,
+			URL:        req.URL,
+			EventTypes: req.EventTypes,
+			Secret:     req.Secret,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, sub)
+	}
+}
+
+func getWebhooks(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subs, err := repo.WebhookSubscriptions(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, subs)
+	}
+}
+
+func deleteWebhook(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid subscription id", http.StatusBadRequest)
+			return
+		}
+
+		err = repo.DeactivateWebhookSubscription(r.Context(), id)
+		if errors.Is(err, repository.ErrWebhookNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func getWebhookDeliveries(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "invalid subscription id", http.StatusBadRequest)
+			return
+		}
+
+		log, err := repo.WebhookDeliveryLog(r.Context(), id)
+		if errors.Is(err, repository.ErrWebhookNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, log)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"github.com/ShiraazMoollatjie/goluhn"
 	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
 	"github.com/antonevtu/go-musthave-diploma/internal/repository"
 	"io"
 	"net/http"
@@ -36,9 +37,11 @@ func getBalance(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 	}
 }
 
+// withdrawal - запрос списания. OrderTotal - сумма заказа, нужна при ограничении доли оплаты баллами
 type withdrawal struct {
-	Order string  `json:"order"`
-	Sum   float64 `json:"sum"`
+	Order      string        `json:"order"`
+	Sum        points.Amount `json:"sum"`
+	OrderTotal points.Amount `json:"order_total"`
 }
 
 func withdrawToOrder(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
@@ -57,16 +60,31 @@ func withdrawToOrder(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
+			if req.Sum <= 0 {
+				http.Error(w, "withdrawal sum must be positive", http.StatusUnprocessableEntity)
+				return
+			}
 
 			err = goluhn.Validate(req.Order)
 			if err != nil {
 				http.Error(w, "luhn validation failed", http.StatusUnprocessableEntity)
+				return
 			}
 
 			userID := r.Context().Value(UserIDKey).(int)
-			err = repo.WithdrawToOrder(r.Context(), userID, req.Order, req.Sum)
+			err = repo.WithdrawToOrder(r.Context(), userID, req.Order, req.Sum, req.OrderTotal)
+			var limitErr *repository.LimitError
+			if errors.As(err, &limitErr) {
+				http.Error(w, limitErr.Error(), http.StatusForbidden)
+				return
+			}
+			if errors.Is(err, repository.ErrOrderTotalRequired) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			if errors.Is(err, repository.ErrNotEnoughFunds) {
 				http.Error(w, err.Error(), http.StatusPaymentRequired)
+				return
 			}
 			if errors.Is(err, repository.ErrOrderAlreadyExists) {
 				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
@@ -74,6 +92,7 @@ func withdrawToOrder(repo Repositorier, cfgApp cfg.Config) http.HandlerFunc {
 			}
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
 			w.WriteHeader(http.StatusOK)
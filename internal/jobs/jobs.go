@@ -0,0 +1,29 @@
+package jobs
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"time"
+)
+
+// Every вызывает fn с периодом interval до отмены контекста. Ошибки пишутся в лог,
+// следующий запуск происходит по расписанию. interval <= 0 - задача отключена
+func Every(ctx context.Context, interval time.Duration, name string, zapLog *zap.SugaredLogger, fn func(ctx context.Context) error) {
+	if interval <= 0 {
+		zapLog.Infow("scheduled job is disabled", "job", name)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := fn(ctx); err != nil && ctx.Err() == nil {
+				zapLog.Infow("scheduled job failed", "job", name, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package jobs
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestEveryDisabled(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		Every(context.Background(), 0, "disabled", zap.NewNop().Sugar(), func(ctx context.Context) error {
+			t.Error("disabled job was called")
+			return nil
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("disabled job did not return")
+	}
+}
+
+func TestEveryRuns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := make(chan struct{}, 10)
+	go Every(ctx, 5*time.Millisecond, "job", zap.NewNop().Sugar(), func(ctx context.Context) error {
+		calls <- struct{}{}
+		return nil
+	})
+
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		assert.Fail(t, "job was not called")
+	}
+}
@@ -7,15 +7,21 @@ import (
 	"os"
 )
 
-func New(logLevel int) (sugarLogger *zap.SugaredLogger, err error) {
-	var level zapcore.Level
+func parseLevel(logLevel int) (zapcore.Level, error) {
 	switch logLevel {
 	case 0:
-		level = zap.DebugLevel
+		return zap.DebugLevel, nil
 	case 1:
-		level = zapcore.InfoLevel
+		return zapcore.InfoLevel, nil
 	default:
-		return nil, errors.New("поддерживаются уровни логгирования 0 - debug и 1 - info")
+		return zap.DebugLevel, errors.New("поддерживаются уровни логгирования 0 - debug и 1 - info")
+	}
+}
+
+func New(logLevel int) (sugarLogger *zap.SugaredLogger, err error) {
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		return nil, err
 	}
 
 	file, err := os.OpenFile("./log_file.txt", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0777)
@@ -36,3 +42,16 @@ func New(logLevel int) (sugarLogger *zap.SugaredLogger, err error) {
 
 	return sugarLogger, nil
 }
+
+// NewStderr - логгер только в stderr: для подкоманд, которые выводят результат в stdout
+func NewStderr(logLevel int) (*zap.SugaredLogger, error) {
+	level, err := parseLevel(logLevel)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.EncodeTime = zapcore.RFC3339TimeEncoder
+	core := zapcore.NewCore(zapcore.NewConsoleEncoder(cfg), zapcore.AddSync(os.Stderr), level)
+	return zap.New(core).Sugar(), nil
+}
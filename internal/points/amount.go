@@ -0,0 +1,159 @@
+package points
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgtype"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount - количество баллов в сотых долях (как numeric(12,2) в БД).
+// В JSON и SQL представлено десятичным числом без потери точности
+type Amount int64
+
+var (
+	ErrInvalid   = errors.New("invalid points amount")
+	ErrNegative  = errors.New("points amount must not be negative")
+	ErrPrecision = errors.New("points amount must have at most two decimal places")
+)
+
+const scale = 100
+
+// Parse разбирает неотрицательное количество баллов с точностью до сотых: "729.98", "500", "1e2"
+func Parse(s string) (Amount, error) {
+	a, err := parse(s)
+	if err != nil {
+		return 0, err
+	}
+	if a < 0 {
+		return 0, ErrNegative
+	}
+	return a, nil
+}
+
+// parse допускает отрицательные значения (проводки журнала, разности)
+func parse(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.ContainsAny(s, "/xX_") {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalid, s)
+	}
+	r.Mul(r, big.NewRat(scale, 1))
+	if !r.IsInt() {
+		return 0, fmt.Errorf("%w: %q", ErrPrecision, s)
+	}
+	if !r.Num().IsInt64() {
+		return 0, fmt.Errorf("%w: %q is out of range", ErrInvalid, s)
+	}
+	return Amount(r.Num().Int64()), nil
+}
+
+// MulRat умножает количество баллов на коэффициент r с округлением до сотых (половина - от нуля)
+func (a Amount) MulRat(r *big.Rat) Amount {
+	v := new(big.Rat).Mul(big.NewRat(int64(a), 1), r)
+	num, den := new(big.Int).Set(v.Num()), v.Denom()
+	// округление: (2*num + sign*den) / (2*den) с отбрасыванием дробной части
+	num.Mul(num, big.NewInt(2))
+	if num.Sign() >= 0 {
+		num.Add(num, den)
+	} else {
+		num.Sub(num, den)
+	}
+	num.Quo(num, new(big.Int).Mul(den, big.NewInt(2)))
+	return Amount(num.Int64())
+}
+
+func (a Amount) String() string {
+	sign := ""
+	v := int64(a)
+	if v < 0 {
+		sign = "-"
+		v = -v
+	}
+	whole, frac := v/scale, v%scale
+	switch {
+	case frac == 0:
+		return sign + strconv.FormatInt(whole, 10)
+	case frac%10 == 0:
+		return fmt.Sprintf("%s%d.%d", sign, whole, frac/10)
+	default:
+		return fmt.Sprintf("%s%d.%02d", sign, whole, frac)
+	}
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON принимает только JSON-числа: неотрицательные, не более двух знаков после запятой
+func (a *Amount) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if strings.HasPrefix(s, `"`) {
+		return fmt.Errorf("%w: must be a number", ErrInvalid)
+	}
+	v, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// UnmarshalText позволяет задавать количество баллов в конфигурации (переменные окружения)
+func (a *Amount) UnmarshalText(text []byte) error {
+	v, err := Parse(string(text))
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Scan реализует sql.Scanner: pgx передает numeric в текстовом виде
+func (a *Amount) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*a = 0
+		return nil
+	case string:
+		return a.scanString(v)
+	case []byte:
+		return a.scanString(string(v))
+	case int64:
+		*a = Amount(v * scale)
+		return nil
+	case float64:
+		return a.scanString(strconv.FormatFloat(v, 'f', -1, 64))
+	default:
+		return fmt.Errorf("cannot scan %T into points.Amount", src)
+	}
+}
+
+func (a *Amount) scanString(s string) error {
+	v, err := parse(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
+
+// Value реализует driver.Valuer
+func (a Amount) Value() (driver.Value, error) {
+	return a.String(), nil
+}
+
+// EncodeText реализует pgtype.TextEncoder. Без него pgx передал бы в numeric
+// значение int64 (сотые доли) как есть
+func (a Amount) EncodeText(ci *pgtype.ConnInfo, buf []byte) ([]byte, error) {
+	return append(buf, a.String()...), nil
+}
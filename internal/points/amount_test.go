@@ -0,0 +1,87 @@
+package points
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Amount
+		wantErr error
+	}{
+		{in: "0", want: 0},
+		{in: "500", want: 50000},
+		{in: "729.98", want: 72998},
+		{in: "0.1", want: 10},
+		{in: "1e2", want: 10000},
+		{in: "0.30", want: 30},
+		{in: "0.001", wantErr: ErrPrecision},
+		{in: "-1", wantErr: ErrNegative},
+		{in: "1/3", wantErr: ErrInvalid},
+		{in: "abc", wantErr: ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var v struct {
+		Sum Amount `json:"sum"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"sum": 0.1}`), &v))
+	a := v.Sum
+	require.NoError(t, json.Unmarshal([]byte(`{"sum": 0.2}`), &v))
+	assert.Equal(t, "0.3", (a + v.Sum).String())
+
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": 1.005}`), &v))
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": -5}`), &v))
+	assert.Error(t, json.Unmarshal([]byte(`{"sum": "5"}`), &v))
+
+	for in, want := range map[Amount]string{50000: "500", 72998: "729.98", 72990: "729.9", 5: "0.05", -150: "-1.5"} {
+		data, err := json.Marshal(in)
+		require.NoError(t, err)
+		assert.Equal(t, want, string(data))
+	}
+}
+
+func TestScan(t *testing.T) {
+	var a Amount
+	require.NoError(t, a.Scan("-12.50"))
+	assert.Equal(t, Amount(-1250), a)
+	require.NoError(t, a.Scan(nil))
+	assert.Equal(t, Amount(0), a)
+	assert.Error(t, a.Scan("1.234"))
+}
+
+func TestMulRat(t *testing.T) {
+	tests := []struct {
+		a    Amount
+		r    string
+		want Amount
+	}{
+		{a: 10000, r: "1.25", want: 12500},
+		{a: 33, r: "1.25", want: 41},
+		{a: 2, r: "1.25", want: 3},
+		{a: 72998, r: "1", want: 72998},
+		{a: -2, r: "1.25", want: -3},
+	}
+	for _, tt := range tests {
+		r, ok := new(big.Rat).SetString(tt.r)
+		require.True(t, ok)
+		assert.Equal(t, tt.want, tt.a.MulRat(r), "%v * %s", tt.a, tt.r)
+	}
+}
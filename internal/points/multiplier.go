@@ -0,0 +1,22 @@
+package points
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+)
+
+var reMultiplier = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?$`)
+
+// ParseMultiplier разбирает коэффициент начислений - неотрицательное десятичное число без экспоненты: "1", "1.25".
+// Дроби вида "5/4", которые принимает big.Rat, не допускаются: коэффициент хранится и отдается в API как есть
+func ParseMultiplier(s string) (*big.Rat, error) {
+	if !reMultiplier.MatchString(s) {
+		return nil, fmt.Errorf("invalid multiplier %q: must be a decimal number", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid multiplier %q: must be a decimal number", s)
+	}
+	return r, nil
+}
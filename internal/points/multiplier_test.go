@@ -0,0 +1,36 @@
+package points
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"testing"
+)
+
+func TestParseMultiplier(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    *big.Rat
+		wantErr bool
+	}{
+		{in: "1", want: big.NewRat(1, 1)},
+		{in: "1.25", want: big.NewRat(5, 4)},
+		{in: "0.5", want: big.NewRat(1, 2)},
+		{in: "5/4", wantErr: true},
+		{in: "1e2", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: ".5", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseMultiplier(tt.in)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, 0, tt.want.Cmp(got))
+		})
+	}
+}
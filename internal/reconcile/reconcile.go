@@ -0,0 +1,48 @@
+package reconcile
+
+import (
+	"context"
+	"expvar"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"go.uber.org/zap"
+	"time"
+)
+
+// метрики сверки, публикуются в /debug/vars
+var (
+	metricRuns       = expvar.NewInt("reconcile_runs")
+	metricFailures   = expvar.NewInt("reconcile_failures")
+	metricMismatches = expvar.NewInt("reconcile_mismatches")
+	metricRepaired   = expvar.NewInt("reconcile_repaired")
+	metricLastRun    = expvar.NewInt("reconcile_last_run_unix")
+	metricDuration   = expvar.NewFloat("reconcile_last_duration_seconds")
+)
+
+type Reconciler interface {
+	Reconcile(ctx context.Context, repair bool) (repository.ReconcileReport, error)
+}
+
+// Run выполняет сверку балансов, обновляет метрики и пишет итог в лог.
+// reconcile_mismatches и reconcile_repaired - значения последнего запуска
+func Run(ctx context.Context, r Reconciler, repair bool, zapLog *zap.SugaredLogger) (repository.ReconcileReport, error) {
+	start := time.Now()
+	metricRuns.Add(1)
+
+	report, err := r.Reconcile(ctx, repair)
+	if err != nil {
+		metricFailures.Add(1)
+		return report, err
+	}
+
+	metricMismatches.Set(int64(len(report.Mismatches)))
+	metricRepaired.Set(int64(report.Repaired))
+	metricLastRun.Set(start.Unix())
+	metricDuration.Set(time.Since(start).Seconds())
+
+	if len(report.Mismatches) > 0 {
+		zapLog.Infow("balance reconciliation found mismatches", "users", report.Users, "mismatches", len(report.Mismatches), "repaired", report.Repaired)
+	} else {
+		zapLog.Infow("balance reconciliation passed", "users", report.Users)
+	}
+	return report, nil
+}
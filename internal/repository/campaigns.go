@@ -0,0 +1,199 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// максимальное количество записей о начисленных бонусах в ответе
+const maxCampaignAwards = 1000
+
+const campaignColumns = "id, name, starts_at, ends_at, coalesce(tier, ''), user_ids, coalesce(order_prefix, ''), multiplier::text, bonus, active, created_at"
+
+// campaignAccount - системный счет кампании: бонусные проводки связаны с кампанией через счет-источник
+func campaignAccount(campaignID int) string {
+	return fmt.Sprintf("system:campaign:%d", campaignID)
+}
+
+func scanCampaign(row pgx.Row) (Campaign, error) {
+	c := Campaign{}
+	var multiplier string
+	err := row.Scan(&c.ID, &c.Name, &c.StartsAt, &c.EndsAt, &c.Tier, &c.UserIDs, &c.OrderPrefix, &multiplier, &c.Bonus, &c.Active, &c.CreatedAt)
+	c.Multiplier = trimMultiplier(multiplier)
+	return c, err
+}
+
+// trimMultiplier убирает незначащие нули numeric: "2.000" -> "2", "1.500" -> "1.5"
+func trimMultiplier(s string) string {
+	if !strings.Contains(s, ".") {
+		return s
+	}
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+func (db *DBT) AddCampaign(ctx context.Context, c Campaign) (Campaign, error) {
+	sql := "insert into campaigns (name, starts_at, ends_at, tier, user_ids, order_prefix, multiplier, bonus)\n" +
+		"values ($1, $2::timestamptz, $3::timestamptz, nullif($4, ''), $5, nullif($6, ''), $7::numeric, $8) returning " + campaignColumns + ";"
+	return scanCampaign(db.pool.QueryRow(ctx, sql, c.Name, c.StartsAt.Format(time.RFC3339Nano), c.EndsAt.Format(time.RFC3339Nano),
+		c.Tier, c.UserIDs, c.OrderPrefix, c.Multiplier, c.Bonus))
+}
+
+func (db *DBT) UpdateCampaign(ctx context.Context, c Campaign) (Campaign, error) {
+	sql := "update campaigns set name = $2, starts_at = $3::timestamptz, ends_at = $4::timestamptz, tier = nullif($5, ''), user_ids = $6,\n" +
+		"order_prefix = nullif($7, ''), multiplier = $8::numeric, bonus = $9, active = $10 where id = $1 returning " + campaignColumns + ";"
+	res, err := scanCampaign(db.pool.QueryRow(ctx, sql, c.ID, c.Name, c.StartsAt.Format(time.RFC3339Nano), c.EndsAt.Format(time.RFC3339Nano),
+		c.Tier, c.UserIDs, c.OrderPrefix, c.Multiplier, c.Bonus, c.Active))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return res, ErrCampaignNotFound
+	}
+	return res, err
+}
+
+// DeactivateCampaign останавливает кампанию. Уже начисленные бонусы сохраняются
+func (db *DBT) DeactivateCampaign(ctx context.Context, id int) error {
+	tag, err := db.pool.Exec(ctx, "update campaigns set active = false where id = $1;", id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrCampaignNotFound
+	}
+	return nil
+}
+
+func (db *DBT) GetCampaign(ctx context.Context, id int) (Campaign, error) {
+	sql := "select " + campaignColumns + " from campaigns where id = $1;"
+	res, err := scanCampaign(db.pool.QueryRow(ctx, sql, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return res, ErrCampaignNotFound
+	}
+	return res, err
+}
+
+func (db *DBT) Campaigns(ctx context.Context) ([]Campaign, error) {
+	sql := "select " + campaignColumns + " from campaigns order by id;"
+	rows, err := db.pool.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]Campaign, 0, 10)
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+	return res, rows.Err()
+}
+
+// CampaignAwards возвращает бонусы, начисленные по кампании, новые первыми
+func (db *DBT) CampaignAwards(ctx context.Context, id int) ([]CampaignAward, error) {
+	_, err := db.GetCampaign(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := "select order_num, user_id, amount, created_at from campaign_awards where campaign_id = $1 order by id desc limit $2;"
+	rows, err := db.pool.Query(ctx, sql, id, maxCampaignAwards)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]CampaignAward, 0, 10)
+	for rows.Next() {
+		a := CampaignAward{CampaignID: id}
+		err = rows.Scan(&a.Order, &a.UserID, &a.Amount, &a.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+	return res, rows.Err()
+}
+
+// applyCampaigns начисляет бонусы действующих кампаний за обработанный заказ.
+// Кампания применяется, если заказ загружен в ее окне и подходит под сегмент.
+// Каждая кампания начисляет бонус за заказ не более одного раза. Возвращает сумму бонусов
+func (db *DBT) applyCampaigns(ctx context.Context, tx pgx.Tx, userID int, order string, accrual points.Amount) (points.Amount, error) {
+	sql := "select c.id, c.multiplier::text, c.bonus from campaigns c, accruals a\n" +
+		"where a.order_num = $1 and c.active and c.starts_at <= a.uploaded_at and c.ends_at > a.uploaded_at\n" +
+		"and (c.order_prefix is null or starts_with($1, c.order_prefix))\n" +
+		"and (c.user_ids is null or $2 = any(c.user_ids))\n" +
+		"and (c.tier is null or c.tier = $3)\n" +
+		"order by c.id;"
+	// уровень считается на момент заказа: сохраненный мог устареть, если начисления вышли из окна 12 месяцев
+	tier, err := db.currentTier(ctx, tx, userID)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(ctx, sql, order, userID, tier)
+	if err != nil {
+		return 0, err
+	}
+
+	type award struct {
+		campaignID int
+		amount     points.Amount
+	}
+	awards := make([]award, 0, 2)
+	for rows.Next() {
+		var id int
+		var multiplier string
+		var bonus points.Amount
+		err = rows.Scan(&id, &multiplier, &bonus)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		m, ok := new(big.Rat).SetString(multiplier)
+		if !ok {
+			rows.Close()
+			return 0, fmt.Errorf("invalid multiplier %q of campaign %d", multiplier, id)
+		}
+		amount := accrual.MulRat(m.Sub(m, big.NewRat(1, 1))) + bonus
+		if amount > 0 {
+			awards = append(awards, award{campaignID: id, amount: amount})
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var total points.Amount
+	sql1 := "insert into campaign_awards (campaign_id, order_num, user_id, amount) values ($1, $2, $3, $4) on conflict do nothing;"
+	for _, a := range awards {
+		tag, err := tx.Exec(ctx, sql1, a.campaignID, order, userID, a.amount)
+		if err != nil {
+			return 0, err
+		}
+		if tag.RowsAffected() == 0 {
+			continue
+		}
+		err = movePoints(ctx, tx, EntryCampaignBonus, order, systemPosting(campaignAccount(a.campaignID), 0), userPosting(userID, 0), a.amount)
+		if err != nil {
+			return 0, err
+		}
+		total += a.amount
+	}
+	if total == 0 {
+		return 0, nil
+	}
+
+	sql2 := "update balance set available = available + $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql2, total, userID)
+	if err != nil {
+		return 0, err
+	}
+	return total, db.addLot(ctx, tx, userID, order, total)
+}
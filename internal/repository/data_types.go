@@ -1,7 +1,9 @@
 package repository
 
 import (
+	"encoding/json"
 	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
 	"time"
 )
 
@@ -14,8 +16,32 @@ var (
 	ErrNotEnoughFunds                    = errors.New("not enough funds in account")
 	ErrOrderAlreadyExists                = errors.New("order already exists")
 	ErrEmptyQueue                        = errors.New("queue is empty")
+	ErrWebhookNotFound                   = errors.New("webhook subscription not found")
+	ErrOrderNotFound                     = errors.New("order not found")
+	ErrIdempotencyKeyMismatch            = errors.New("idempotency key was used with a different request")
+	ErrIdempotencyKeyInProgress          = errors.New("request with this idempotency key is in progress")
+	ErrSelfTransfer                      = errors.New("can't transfer points to yourself")
+	ErrWithdrawalNotFound                = errors.New("withdrawal not found")
+	ErrAlreadyRefunded                   = errors.New("withdrawal is already fully refunded")
+	ErrRefundExceedsWithdrawal           = errors.New("refund exceeds the non-refunded part of withdrawal")
+	ErrHoldNotFound                      = errors.New("hold not found")
+	ErrHoldNotActive                     = errors.New("hold is already captured, voided or expired")
+	ErrOrderTotalRequired                = errors.New("order total is required to check the share payable in points")
+	ErrCampaignNotFound                  = errors.New("campaign not found")
+	ErrUnknownReferralCode               = errors.New("unknown referral code")
+	ErrReferralCodeBusy                  = errors.New("referral code is already taken")
+	ErrDeadLetterNotFound                = errors.New("order is not in dead letter")
 )
 
+// LimitError - нарушение ограничения на операцию с баллами. Rule - имя правила
+type LimitError struct {
+	Rule string
+}
+
+func (e *LimitError) Error() string {
+	return "limit exceeded: " + e.Rule
+}
+
 // статусы начисления баллов заказам
 var (
 	AccrualNew        = "NEW"
@@ -24,11 +50,43 @@ var (
 	AccrualProcessed  = "PROCESSED"
 )
 
+// типы событий пользователя (SSE)
+const (
+	EventOrderStatusChanged = "order.status_changed"
+	EventBalanceChanged     = "balance.changed"
+	EventWithdrawalCreated  = "withdrawal.created"
+	EventWithdrawalRefunded = "withdrawal.refunded"
+	EventTierChanged        = "tier.changed"
+)
+
+// канал Postgres LISTEN/NOTIFY для рассылки событий между экземплярами сервиса
+const EventsChannel = "user_events"
+
+// канал Postgres LISTEN/NOTIFY, по которому пул опроса системы начислений узнает о новых заказах в очереди.
+// Полезная нагрузка - номер заказа
+const QueueChannel = "accrual_queue"
+
+// типы событий вебхуков партнеров
+const (
+	WebhookOrderProcessed = "order.processed"
+	WebhookOrderInvalid   = "order.invalid"
+)
+
+// статусы доставки вебхуков
+var (
+	WebhookPending   = "PENDING"
+	WebhookDelivered = "DELIVERED"
+	WebhookFailed    = "FAILED"
+)
+
 type RegisterNewUser struct {
 	Login   string
 	PwdHash string
 	PwdSalt string
 	JWTSalt string
+	// собственный код приглашения и код пригласившего (может быть пустым)
+	ReferralCode string
+	ReferredBy   string
 }
 
 type LoginUser struct {
@@ -39,22 +97,321 @@ type LoginUser struct {
 
 type OrderList []orderItem
 type orderItem struct {
-	Number       string    `json:"number"`
-	Status       string    `json:"status"`
-	Accrual      float64   `json:"accrual,omitempty"`
-	UploadedAt   string    `json:"uploaded_at"`
-	UploadedAtGo time.Time `json:"-"`
+	Number        string        `json:"number"`
+	Status        string        `json:"status"`
+	Accrual       points.Amount `json:"accrual,omitempty"`
+	UploadedAt    string        `json:"uploaded_at"`
+	UploadedAtGo  time.Time     `json:"-"`
+	ProcessedAt   string        `json:"processed_at,omitempty"`
+	ProcessedAtGo *time.Time    `json:"-"`
+}
+
+// OrderDetails - заказ с историей смены статусов
+type OrderDetails struct {
+	orderItem
+	History []statusChange `json:"history"`
+}
+
+type statusChange struct {
+	Status      string          `json:"status"`
+	ChangedAt   string          `json:"changed_at"`
+	ChangedAtGo time.Time       `json:"-"`
+	Raw         json.RawMessage `json:"raw,omitempty"`
 }
 
 type Balance struct {
-	Current   float64 `json:"current"`
-	Withdrawn float64 `json:"withdrawn"`
+	Current   points.Amount `json:"current"`
+	Withdrawn points.Amount `json:"withdrawn"`
+	Held      points.Amount `json:"held,omitempty"`
+	Expiring  []Expiration  `json:"expiring,omitempty"`
+}
+
+// Campaign - промо-кампания: бонус к начислениям за заказы, загруженные в окне [StartsAt, EndsAt).
+// Пустые Tier, UserIDs и OrderPrefix - кампания действует для всех
+type Campaign struct {
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	StartsAt    time.Time     `json:"starts_at"`
+	EndsAt      time.Time     `json:"ends_at"`
+	Tier        string        `json:"tier,omitempty"`
+	UserIDs     []int         `json:"user_ids,omitempty"`
+	OrderPrefix string        `json:"order_prefix,omitempty"`
+	Multiplier  string        `json:"multiplier"`
+	Bonus       points.Amount `json:"bonus"`
+	Active      bool          `json:"active"`
+	CreatedAt   time.Time     `json:"created_at"`
+}
+
+// CampaignAward - бонус кампании, начисленный за заказ
+type CampaignAward struct {
+	CampaignID int           `json:"campaign_id"`
+	Order      string        `json:"order"`
+	UserID     int           `json:"user_id"`
+	Amount     points.Amount `json:"amount"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// ReferralStats - код приглашения пользователя и статистика приглашенных им пользователей
+type ReferralStats struct {
+	Code      string         `json:"referral_code"`
+	Invited   int            `json:"invited"`
+	Rewarded  int            `json:"rewarded"`
+	Earned    points.Amount  `json:"earned"`
+	Referrals []ReferralItem `json:"referrals"`
+}
+
+// ReferralItem - приглашенный пользователь (без логина)
+type ReferralItem struct {
+	JoinedAt   string        `json:"joined_at"`
+	Status     string        `json:"status"`
+	RewardedAt string        `json:"rewarded_at,omitempty"`
+	Bonus      points.Amount `json:"bonus,omitempty"`
+}
+
+// ReconcileReport - отчет сверки балансов
+type ReconcileReport struct {
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at"`
+	Users      int        `json:"users_checked"`
+	Repaired   int        `json:"repaired"`
+	Mismatches []Mismatch `json:"mismatches"`
+}
+
+// Mismatch - расхождение сверки: Expected - значение по источнику (журнал или accruals/withdrawns),
+// Actual - проверяемое значение (кэш balance или журнал)
+type Mismatch struct {
+	Kind     string        `json:"kind"`
+	UserID   int           `json:"user_id"`
+	Order    string        `json:"order,omitempty"`
+	Expected points.Amount `json:"expected"`
+	Actual   points.Amount `json:"actual"`
+	Repaired bool          `json:"repaired"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// Profile - профиль пользователя с уровнем программы лояльности
+type Profile struct {
+	Login             string        `json:"login"`
+	ReferralCode      string        `json:"referral_code"`
+	RegisteredAt      string        `json:"registered_at"`
+	Accrued12m        points.Amount `json:"accrued_12m"`
+	Tier              string        `json:"tier,omitempty"`
+	Multiplier        json.Number   `json:"multiplier,omitempty"`
+	NextTier          string        `json:"next_tier,omitempty"`
+	NextTierThreshold points.Amount `json:"next_tier_threshold,omitempty"`
+	ToNextTier        points.Amount `json:"to_next_tier,omitempty"`
+}
+
+type tierEvent struct {
+	Previous string `json:"previous,omitempty"`
+	Tier     string `json:"tier"`
+}
+
+// Statement - выписка по счету баллов за период с входящим и исходящим остатком
+type Statement struct {
+	From    string           `json:"from,omitempty"`
+	To      string           `json:"to"`
+	Opening points.Amount    `json:"opening_balance"`
+	Closing points.Amount    `json:"closing_balance"`
+	Entries []StatementEntry `json:"entries"`
+}
+
+// StatementEntry - движение баллов с остатком после него
+type StatementEntry struct {
+	Date    string        `json:"date"`
+	Type    string        `json:"type"`
+	Order   string        `json:"order,omitempty"`
+	Amount  points.Amount `json:"amount"`
+	Balance points.Amount `json:"balance"`
+}
+
+// Expiration - баллы, которые сгорят в момент At
+type Expiration struct {
+	Amount points.Amount `json:"amount"`
+	At     string        `json:"at"`
 }
 
 type WithdrawalsList []withdrawalItem
 type withdrawalItem struct {
-	Order         string    `json:"order"`
-	Sum           float64   `json:"sum"`
-	ProcessedAt   string    `json:"processed_at"`
-	ProcessedAtGo time.Time `json:"-"`
+	Order         string        `json:"order"`
+	Sum           points.Amount `json:"sum"`
+	ProcessedAt   string        `json:"processed_at"`
+	ProcessedAtGo time.Time     `json:"-"`
+	Refunded      points.Amount `json:"refunded,omitempty"`
+	RefundStatus  string        `json:"refund_status,omitempty"`
+}
+
+// статусы резерва баллов
+const (
+	HoldActive   = "HELD"
+	HoldCaptured = "CAPTURED"
+	HoldVoided   = "VOIDED"
+	HoldExpired  = "EXPIRED"
+)
+
+// Hold - резерв баллов под оплату заказа
+type Hold struct {
+	ID           int64         `json:"id"`
+	Order        string        `json:"order"`
+	Amount       points.Amount `json:"amount"`
+	Status       string        `json:"status"`
+	CreatedAt    string        `json:"created_at"`
+	ExpiresAt    string        `json:"expires_at"`
+	ResolvedAt   string        `json:"resolved_at,omitempty"`
+	CreatedAtGo  time.Time     `json:"-"`
+	ExpiresAtGo  time.Time     `json:"-"`
+	ResolvedAtGo *time.Time    `json:"-"`
+}
+
+func (h *Hold) formatTimes() {
+	h.CreatedAt = h.CreatedAtGo.Format(time.RFC3339)
+	h.ExpiresAt = h.ExpiresAtGo.Format(time.RFC3339)
+	if h.ResolvedAtGo != nil {
+		h.ResolvedAt = h.ResolvedAtGo.Format(time.RFC3339)
+	}
+}
+
+// статусы возврата списания
+const (
+	RefundPartial = "PARTIALLY_REFUNDED"
+	RefundFull    = "REFUNDED"
+)
+
+// RefundItem - возврат баллов по списанию
+type RefundItem struct {
+	ID          int64         `json:"id"`
+	Order       string        `json:"order"`
+	Amount      points.Amount `json:"amount"`
+	Reason      string        `json:"reason,omitempty"`
+	CreatedAt   string        `json:"created_at"`
+	CreatedAtGo time.Time     `json:"-"`
+}
+
+type refundEvent struct {
+	Order  string        `json:"order"`
+	Amount points.Amount `json:"amount"`
+	Status string        `json:"refund_status"`
+}
+
+// направления переводов баллов
+const (
+	TransferIn  = "in"
+	TransferOut = "out"
+)
+
+type TransfersList []TransferItem
+type TransferItem struct {
+	ID          int64         `json:"id"`
+	Direction   string        `json:"direction"`
+	Login       string        `json:"login"`
+	Amount      points.Amount `json:"amount"`
+	CreatedAt   string        `json:"created_at"`
+	CreatedAtGo time.Time     `json:"-"`
+}
+
+type Event struct {
+	ID        int64           `json:"id"`
+	UserID    int             `json:"user_id"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+type orderStatusEvent struct {
+	Number  string        `json:"number"`
+	Status  string        `json:"status"`
+	Accrual points.Amount `json:"accrual,omitempty"`
+}
+
+type withdrawalEvent struct {
+	Order       string        `json:"order"`
+	Sum         points.Amount `json:"sum"`
+	ProcessedAt string        `json:"processed_at"`
+}
+
+type WebhookSubscription struct {
+	ID         int       `json:"id"`
+	Partner    string    `json:"partner"`
+	URL        string    `json:"url"`
+	EventTypes []string  `json:"event_types"`
+	Secret     string    `json:"secret,omitempty"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type orderWebhookEvent struct {
+	Order       string        `json:"order"`
+	Status      string        `json:"status"`
+	Accrual     points.Amount `json:"accrual,omitempty"`
+	ProcessedAt string        `json:"processed_at"`
+}
+
+// WebhookDelivery - доставка события одному подписчику, захваченная диспетчером
+type WebhookDelivery struct {
+	ID        int64
+	EventID   int64
+	Attempt   int
+	URL       string
+	Secret    string
+	EventType string
+	Payload   []byte
+}
+
+// WebhookAttempt - результат попытки доставки. Status определяет дальнейшую судьбу доставки:
+// PENDING - повтор через RetryIn, DELIVERED и FAILED - окончательные
+type WebhookAttempt struct {
+	DeliveryID   int64
+	Attempt      int
+	ResponseCode int
+	Error        string
+	Duration     time.Duration
+	Status       string
+	RetryIn      time.Duration
+}
+
+type WebhookLogItem struct {
+	DeliveryID   int64     `json:"delivery_id"`
+	EventID      int64     `json:"event_id"`
+	EventType    string    `json:"event_type"`
+	Attempt      int       `json:"attempt"`
+	ResponseCode int       `json:"response_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	DurationMs   int       `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// IdempotentResponse - сохраненный ответ на запрос с заголовком Idempotency-Key
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+// QueueItem - заказ, захваченный из очереди опроса системы начислений. Attempt - номер текущей попытки
+type QueueItem struct {
+	Order   string
+	Attempt int
+	// срок захвата заказа по часам экземпляра сервиса
+	ClaimedUntil time.Time
+}
+
+// OrderRetry - возврат заказа в очередь после попытки опроса. Attempts - засчитанные попытки,
+// следующая попытка через RetryIn. DeadLetter - попытки исчерпаны, заказ больше не опрашивается
+type OrderRetry struct {
+	Status     string
+	Raw        []byte
+	Error      string
+	Attempts   int
+	RetryIn    time.Duration
+	DeadLetter bool
+}
+
+// DeadLetter - заказ, исчерпавший попытки опроса системы начислений
+type DeadLetter struct {
+	Order          string    `json:"order"`
+	UserID         int       `json:"user_id"`
+	Attempts       int       `json:"attempts"`
+	LastError      string    `json:"last_error,omitempty"`
+	UploadedAt     time.Time `json:"uploaded_at"`
+	DeadLetteredAt time.Time `json:"dead_lettered_at"`
 }
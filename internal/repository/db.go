@@ -6,6 +6,8 @@ import (
 	"embed"
 	"errors"
 	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/tiers"
 	"github.com/jackc/pgconn"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v4"
@@ -17,8 +19,12 @@ import (
 )
 
 type DBT struct {
-	pool *pgxpool.Pool
-	log  *zap.SugaredLogger
+	pool           *pgxpool.Pool
+	log            *zap.SugaredLogger
+	pointsLifetime int
+	limits         WithdrawalLimits
+	tiers          tiers.Tiers
+	referralBonus  ReferralBonus
 }
 
 //go:embed migrations/*.sql
@@ -75,7 +81,7 @@ func (db *DBT) CreateTables(ctx context.Context) (err error) {
 }
 
 func (db *DBT) DropTables(ctx context.Context) (err error) {
-	sql := "drop table if exists goose_db_version, users, tokens, orders, accruals, withdrawns, balance, queue cascade;"
+	sql := "drop table if exists goose_db_version, users, tokens, orders, accruals, withdrawns, balance, queue, user_events, order_status_history, idempotency_keys, webhook_subscriptions, webhook_outbox, webhook_deliveries, webhook_delivery_log, ledger_entries, point_lots, lot_usages, transfers, withdrawal_refunds, holds, user_tiers, campaigns, campaign_awards, referrals, reconciliation_audit cascade;\ndrop sequence if exists ledger_tx_seq;"
 	_, err = db.pool.Exec(ctx, sql)
 	return err
 }
@@ -88,34 +94,47 @@ func (db *DBT) Register(ctx context.Context, user RegisterNewUser) (userID int,
 	defer tx.Rollback(ctx)
 
 	// добавление пользователя в users
-	sql := "insert into users (login, pwd, pwd_salt) values($1, $2, $3) returning user_id"
-	resp := db.pool.QueryRow(ctx, sql, user.Login, user.PwdHash, user.PwdSalt)
+	sql := "insert into users (login, pwd, pwd_salt, referral_code) values($1, $2, $3, $4) returning user_id"
+	resp := tx.QueryRow(ctx, sql, user.Login, user.PwdHash, user.PwdSalt, user.ReferralCode)
 
 	var pgErr *pgconn.PgError
 
 	err = resp.Scan(&userID)
 	if errors.As(err, &pgErr) {
 		if pgErr.Code == pgerrcode.UniqueViolation {
+			// совпадение случайного кода приглашения - регистрацию можно повторить с новым кодом
+			if pgErr.ConstraintName == "users_referral_code_idx" {
+				return 0, ErrReferralCodeBusy
+			}
 			return 0, ErrLoginBusy
 		}
+		return 0, err
 	} else if err != nil {
 		return 0, err
 	}
 
 	// добавление баланса пользователя в balance
 	sql1 := "insert into balance (user_id) values ($1);"
-	_, err = db.pool.Exec(ctx, sql1, userID)
+	_, err = tx.Exec(ctx, sql1, userID)
 	if err != nil {
 		return 0, err
 	}
 
 	// добавление ключа jwt-токена в tokens
 	sql2 := "insert into tokens (user_id, key_salt) values ($1, $2);"
-	_, err = db.pool.Exec(ctx, sql2, userID, user.JWTSalt)
+	_, err = tx.Exec(ctx, sql2, userID, user.JWTSalt)
 	if err != nil {
 		return 0, err
 	}
 
+	// регистрация по приглашению
+	if user.ReferredBy != "" {
+		err = addReferral(ctx, tx, userID, user.ReferredBy)
+		if err != nil {
+			return 0, err
+		}
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		return 0, fmt.Errorf("unable to commit: %w", err)
 	}
@@ -159,12 +178,13 @@ func (db *DBT) PostOrder(ctx context.Context, userID int, order string) error {
 
 	// добавление заказа в orders. Проверка на уникальность
 	sql := "insert into orders (order_num, user_id) values ($1, $2)"
-	_, err = db.pool.Exec(ctx, sql, order, userID)
+	_, err = tx.Exec(ctx, sql, order, userID)
 
 	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
 
-		// конфликт номера заказов. Проверка, какой пользователь сделал заказ ранее
+		// конфликт номера заказов. Проверка, какой пользователь сделал заказ ранее.
+		// Транзакция после ошибки прервана, поэтому запрос вне нее
 		if pgErr.Code == pgerrcode.UniqueViolation {
 			sql1 := "select user_id from orders where order_num = $1;"
 			resp := db.pool.QueryRow(ctx, sql1, order)
@@ -179,6 +199,7 @@ func (db *DBT) PostOrder(ctx context.Context, userID int, order string) error {
 				return ErrDuplicateOrderNumberByAnotherUser
 			}
 		}
+		return err
 
 	} else if err != nil {
 		return err
@@ -186,12 +207,20 @@ func (db *DBT) PostOrder(ctx context.Context, userID int, order string) error {
 
 	// добавление номера заказов в историю и очередь на начисление баллов
 	sql2 := "insert into accruals (order_num, status) values ($1, $2);"
-	_, err = db.pool.Exec(ctx, sql2, order, AccrualNew)
+	_, err = tx.Exec(ctx, sql2, order, AccrualNew)
+	if err != nil {
+		return err
+	}
+	err = addStatusChange(ctx, tx, order, AccrualNew, nil)
 	if err != nil {
 		return err
 	}
 	sql3 := "insert into queue (order_num, user_id) values ($1, $2);"
-	_, err = db.pool.Exec(ctx, sql3, order, userID)
+	_, err = tx.Exec(ctx, sql3, order, userID)
+	if err != nil {
+		return err
+	}
+	err = notifyQueue(ctx, tx, order)
 	if err != nil {
 		return err
 	}
@@ -206,7 +235,7 @@ func (db *DBT) PostOrder(ctx context.Context, userID int, order string) error {
 
 func (db *DBT) GetOrders(ctx context.Context, userID int) (OrderList, error) {
 
-	sql := "select order_num, status, accrual, uploaded_at from accruals where order_num in (select order_num from orders where user_id = $1);"
+	sql := "select order_num, status, accrual, uploaded_at, processed_at from accruals where order_num in (select order_num from orders where user_id = $1);"
 	rows, err := db.pool.Query(ctx, sql, userID)
 	if err != nil {
 		return nil, err
@@ -215,25 +244,47 @@ func (db *DBT) GetOrders(ctx context.Context, userID int) (OrderList, error) {
 	res := make(OrderList, 0, 10)
 	item := orderItem{}
 	for rows.Next() {
-		err = rows.Scan(&item.Number, &item.Status, &item.Accrual, &item.UploadedAtGo)
+		item.ProcessedAt, item.ProcessedAtGo = "", nil
+		err = rows.Scan(&item.Number, &item.Status, &item.Accrual, &item.UploadedAtGo, &item.ProcessedAtGo)
 		if err != nil {
 			return nil, err
 		}
 		item.UploadedAt = item.UploadedAtGo.Format(time.RFC3339)
+		if item.ProcessedAtGo != nil {
+			item.ProcessedAt = item.ProcessedAtGo.Format(time.RFC3339)
+		}
 		res = append(res, item)
 	}
 	return res, nil
 }
 
+// Balance вычисляется по журналу баллов (списано - сумма списаний за вычетом возвратов,
+// зарезервировано - остаток на счетах резервов пользователя).
+// Таблица balance - кэш для проверки остатка при списании, расхождение с журналом пишется в лог
 func (db *DBT) Balance(ctx context.Context, userID int) (Balance, error) {
-	sql := "select available, withdrawn from balance where user_id = $1"
-	resp := db.pool.QueryRow(ctx, sql, userID)
+	sql := "select coalesce(sum(l.amount) filter (where l.account = $3), 0),\n" +
+		"coalesce(-sum(l.amount) filter (where l.entry_type in ($2, $4)), 0),\n" +
+		"coalesce(sum(l.amount) filter (where l.account like 'hold:%'), 0), b.available, b.withdrawn, b.held\n" +
+		"from balance b left join ledger_entries l on l.user_id = b.user_id\n" +
+		"where b.user_id = $1 group by b.available, b.withdrawn, b.held;"
+	resp := db.pool.QueryRow(ctx, sql, userID, EntryWithdrawal, userAccount(userID), EntryRefund)
 	bal := Balance{}
-	err := resp.Scan(&bal.Current, &bal.Withdrawn)
+	var cached Balance
+	err := resp.Scan(&bal.Current, &bal.Withdrawn, &bal.Held, &cached.Current, &cached.Withdrawn, &cached.Held)
+	if err != nil {
+		return bal, err
+	}
+	if bal.Current != cached.Current || bal.Withdrawn != cached.Withdrawn || bal.Held != cached.Held {
+		db.log.Infow("balance cache differs from ledger", "userID", userID, "ledger", bal, "cache", cached)
+	}
+
+	bal.Expiring, err = db.expiringPoints(ctx, userID)
 	return bal, err
 }
 
-func (db *DBT) WithdrawToOrder(ctx context.Context, userID int, order string, sum float64) error {
+// WithdrawToOrder списывает sum баллов в оплату заказа order на сумму orderTotal
+// (сумма заказа нужна для ограничения доли оплаты баллами, 0 - не указана)
+func (db *DBT) WithdrawToOrder(ctx context.Context, userID int, order string, sum, orderTotal points.Amount) error {
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
 		return err
@@ -241,23 +292,29 @@ func (db *DBT) WithdrawToOrder(ctx context.Context, userID int, order string, su
 	defer tx.Rollback(ctx)
 
 	// добавление заказа в orders. Проверка на уникальность
-	sql := "insert into orders (order_num, user_id) values ($1, $2)"
-	_, err = db.pool.Exec(ctx, sql, order, userID)
+	err = addWithdrawalOrder(ctx, tx, userID, order)
+	if err != nil {
+		return err
+	}
 
-	var pgErr *pgconn.PgError
-	if errors.As(err, &pgErr) {
-		// конфликт номера заказов. Проверка, какой пользователь сделал заказ ранее
-		if pgErr.Code == pgerrcode.UniqueViolation {
-			return ErrOrderAlreadyExists
-		}
+	// списание из партий баллов со сроком сгорания
+	parts, err := consumeLots(ctx, tx, userID, sum)
+	if err != nil {
+		return err
+	}
+	err = recordLotUsages(ctx, tx, parts, order, 0)
+	if err != nil {
+		return err
 	}
+	err = db.checkWithdrawalLimits(ctx, tx, userID, sum, orderTotal)
 	if err != nil {
 		return err
 	}
 
 	// проверка баланса и списание
 	sql2 := "update balance set available = available - $1, withdrawn = withdrawn + $1 where user_id = $2;"
-	_, err = db.pool.Exec(ctx, sql2, sum, userID)
+	_, err = tx.Exec(ctx, sql2, sum, userID)
+	var pgErr *pgconn.PgError
 	if errors.As(err, &pgErr) {
 		if pgErr.Code == pgerrcode.CheckViolation {
 			return ErrNotEnoughFunds
@@ -266,10 +323,17 @@ func (db *DBT) WithdrawToOrder(ctx context.Context, userID int, order string, su
 	if err != nil {
 		return err
 	}
+	err = movePoints(ctx, tx, EntryWithdrawal, order, userPosting(userID, 0), systemPosting(accountRedemption, 0), sum)
+	if err != nil {
+		return err
+	}
 
 	// занесение в историю списаний
-	sql1 := "insert into withdrawns (order_num, withdrawn) values ($1, $2);"
-	_, err = db.pool.Exec(ctx, sql1, order, sum)
+	err = addWithdrawal(ctx, tx, userID, order, sum)
+	if err != nil {
+		return err
+	}
+	err = addBalanceEvent(ctx, tx, userID)
 	if err != nil {
 		return err
 	}
@@ -280,9 +344,32 @@ func (db *DBT) WithdrawToOrder(ctx context.Context, userID int, order string, su
 	return err
 }
 
+// addWithdrawalOrder регистрирует номер заказа, оплачиваемого баллами
+func addWithdrawalOrder(ctx context.Context, tx pgx.Tx, userID int, order string) error {
+	sql := "insert into orders (order_num, user_id) values ($1, $2)"
+	_, err := tx.Exec(ctx, sql, order, userID)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return ErrOrderAlreadyExists
+	}
+	return err
+}
+
+// addWithdrawal заносит списание в историю и уведомляет подписчиков (SSE)
+func addWithdrawal(ctx context.Context, tx pgx.Tx, userID int, order string, sum points.Amount) error {
+	sql := "insert into withdrawns (order_num, withdrawn) values ($1, $2) returning processed_at;"
+	var processedAt time.Time
+	err := tx.QueryRow(ctx, sql, order, sum).Scan(&processedAt)
+	if err != nil {
+		return err
+	}
+	return addEvent(ctx, tx, userID, EventWithdrawalCreated, withdrawalEvent{Order: order, Sum: sum, ProcessedAt: processedAt.Format(time.RFC3339)})
+}
+
 func (db *DBT) GetWithdrawals(ctx context.Context, userID int) (WithdrawalsList, error) {
 
-	sql := "select order_num, withdrawn, processed_at from withdrawns where order_num in (select order_num from orders where user_id = $1);"
+	sql := "select order_num, withdrawn, processed_at, refunded from withdrawns where order_num in (select order_num from orders where user_id = $1);"
 	rows, err := db.pool.Query(ctx, sql, userID)
 	if err != nil {
 		return nil, err
@@ -291,18 +378,61 @@ func (db *DBT) GetWithdrawals(ctx context.Context, userID int) (WithdrawalsList,
 	res := make(WithdrawalsList, 0, 10)
 	item := withdrawalItem{}
 	for rows.Next() {
-		err = rows.Scan(&item.Order, &item.Sum, &item.ProcessedAtGo)
+		err = rows.Scan(&item.Order, &item.Sum, &item.ProcessedAtGo, &item.Refunded)
 		if err != nil {
 			return nil, err
 		}
 		item.ProcessedAt = item.ProcessedAtGo.Format(time.RFC3339)
+		item.RefundStatus = refundStatus(item.Sum, item.Refunded)
 		res = append(res, item)
 	}
 	return res, nil
 }
 
+// PutTestAccrual устанавливает всем пользователям баланс 1000 корректирующими проводками (для тестов)
 func (db *DBT) PutTestAccrual(ctx context.Context) (err error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := "select user_id, 1000 - available from balance where available <> 1000 for update;"
+	rows, err := tx.Query(ctx, sql)
+	if err != nil {
+		return err
+	}
+	corrections := make(map[int]points.Amount)
+	for rows.Next() {
+		var userID int
+		var delta points.Amount
+		err = rows.Scan(&userID, &delta)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		corrections[userID] = delta
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for userID, delta := range corrections {
+		err = movePoints(ctx, tx, EntryCorrection, "", systemPosting(accountCorrection, 0), userPosting(userID, 0), delta)
+		if err != nil {
+			return err
+		}
+	}
+
 	sql2 := "update balance set available = 1000;"
-	_, err = db.pool.Exec(ctx, sql2)
-	return err
+	_, err = tx.Exec(ctx, sql2)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
 }
@@ -4,37 +4,201 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
 	"github.com/jackc/pgx/v4"
+	"time"
 )
 
-func (db *DBT) OldestFromQueue(ctx context.Context) (order string, err error) {
-	sql := "update queue set last_checked_at = default, in_handling = true\nwhere order_num in (select order_num from queue where in_handling = false order by last_checked_at limit 1)\nreturning order_num;"
-	resp := db.pool.QueryRow(ctx, sql)
-	err = resp.Scan(&order)
+// notifyQueue будит пул опроса системы начислений после commit транзакции, поставившей заказ в очередь
+func notifyQueue(ctx context.Context, tx pgx.Tx, order string) error {
+	sql := "select pg_notify($1, $2);"
+	_, err := tx.Exec(ctx, sql, QueueChannel, order)
+	return err
+}
+
+// ClaimBatch захватывает до n заказов, дольше всех ожидающих очередной попытки опроса, для экземпляра
+// сервиса workerID на время lease. Заказы с отложенной попыткой, отправленные в dead letter и захваченные
+// другими экземплярами пропускаются: строки, заблокированные параллельным захватом, не ожидаются (skip locked)
+func (db *DBT) ClaimBatch(ctx context.Context, n int, workerID string, lease time.Duration) ([]QueueItem, error) {
+	// срок захвата отсчитывается до запроса - по часам экземпляра он не позже, чем в базе
+	claimedUntil := time.Now().Add(lease)
+	sql := `update queue set last_checked_at = default, in_handling = true, claimed_by = $2,
+	claimed_until = now() + make_interval(secs => $3)
+	where order_num in (select order_num from queue
+		where in_handling = false and dead_lettered_at is null and next_attempt_at <= now()
+		order by next_attempt_at limit $1 for update skip locked)
+	returning order_num, attempts + 1`
+	rows, err := db.pool.Query(ctx, sql, n, workerID, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]QueueItem, 0, n)
+	for rows.Next() {
+		item := QueueItem{ClaimedUntil: claimedUntil}
+		err = rows.Scan(&item.Order, &item.Attempt)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, ErrEmptyQueue
+	}
+	return items, nil
+}
+
+// ReleaseExpiredClaims возвращает в очередь заказы, срок захвата которых истек: экземпляр сервиса,
+// захвативший их, остановился аварийно. Возвращает количество освобожденных заказов
+func (db *DBT) ReleaseExpiredClaims(ctx context.Context) (int, error) {
+	sql := `update queue set in_handling = false, claimed_by = null, claimed_until = null
+	where in_handling = true and (claimed_until is null or claimed_until < now())`
+	tag, err := db.pool.Exec(ctx, sql)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// ReleaseClaims возвращает в очередь все заказы, захваченные экземпляром workerID, без расхода попытки
+func (db *DBT) ReleaseClaims(ctx context.Context, workerID string) (int, error) {
+	sql := `update queue set in_handling = false, claimed_by = null, claimed_until = null
+	where in_handling = true and claimed_by = $1`
+	tag, err := db.pool.Exec(ctx, sql, workerID)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// DeferOrder возвращает захваченный экземпляром workerID заказ в очередь до следующей попытки
+// через r.RetryIn либо отправляет его в dead letter. Непустой r.Status - промежуточный статус из системы
+// начислений (PROCESSING): его смена сохраняется в истории вместе с ответом r.Raw.
+// Если срок захвата истек и заказ передан другому экземпляру, заказ не изменяется
+func (db *DBT) DeferOrder(ctx context.Context, workerID, order string, r OrderRetry) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `update queue set in_handling = false, claimed_by = null, claimed_until = null, attempts = $2, last_error = nullif($3, ''),
+	next_attempt_at = now() + make_interval(secs => $4), dead_lettered_at = case when $5 then now() end
+	where order_num = $1 and claimed_by = $6 returning user_id`
+	var userID int
+	err = tx.QueryRow(ctx, sql, order, r.Attempts, r.Error, r.RetryIn.Seconds(), r.DeadLetter, workerID).Scan(&userID)
 	if errors.Is(err, pgx.ErrNoRows) {
-		return "", ErrEmptyQueue
+		// заказ уже удален из очереди или захвачен другим экземпляром
+		db.log.Infow("order claim lost, retry is not saved", "order", order, "instance", workerID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.DeadLetter {
+		db.log.Infow("order moved to dead letter", "order", order, "attempts", r.Attempts, "error", r.Error)
+	}
+
+	if r.Status != "" {
+		sql1 := "update accruals set status = $1 where order_num = $2 and status <> $1;"
+		tag, err := tx.Exec(ctx, sql1, r.Status, order)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() > 0 {
+			err = addStatusChange(ctx, tx, order, r.Status, r.Raw)
+			if err != nil {
+				return err
+			}
+			err = addEvent(ctx, tx, userID, EventOrderStatusChanged, orderStatusEvent{Number: order, Status: r.Status})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
+
+// DeadLetters возвращает заказы, исчерпавшие попытки опроса системы начислений
+func (db *DBT) DeadLetters(ctx context.Context) ([]DeadLetter, error) {
+	sql := `select order_num, user_id, attempts, coalesce(last_error, ''), uploaded_at, dead_lettered_at
+	from queue where dead_lettered_at is not null order by dead_lettered_at`
+	rows, err := db.pool.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]DeadLetter, 0)
+	for rows.Next() {
+		item := DeadLetter{}
+		err = rows.Scan(&item.Order, &item.UserID, &item.Attempts, &item.LastError, &item.UploadedAt, &item.DeadLetteredAt)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, rows.Err()
+}
+
+// RetryDeadLetter возвращает заказ из dead letter в очередь с обнуленным счетчиком попыток
+func (db *DBT) RetryDeadLetter(ctx context.Context, order string) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `update queue set attempts = 0, next_attempt_at = now(), dead_lettered_at = null
+	where order_num = $1 and dead_lettered_at is not null`
+	tag, err := tx.Exec(ctx, sql, order)
+	if err != nil {
+		return err
 	}
-	return order, err
+	if tag.RowsAffected() == 0 {
+		return ErrDeadLetterNotFound
+	}
+	err = notifyQueue(ctx, tx, order)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
 }
 
-func (db *DBT) DeferOrder(ctx context.Context, order, status string) error {
+// DiscardDeadLetter удаляет заказ из dead letter, завершая его со статусом INVALID
+func (db *DBT) DiscardDeadLetter(ctx context.Context, order string) error {
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
-	sql := "update queue set in_handling = false where order_num = $1"
-	_, err = db.pool.Exec(ctx, sql, order)
+	sql := "select 1 from queue where order_num = $1 and dead_lettered_at is not null for update"
+	var found int
+	err = tx.QueryRow(ctx, sql, order).Scan(&found)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrDeadLetterNotFound
+	}
 	if err != nil {
 		return err
 	}
 
-	//sql1 := "update accruals set status = $1 where order_num = $2;"
-	//_, err = db.pool.Exec(ctx, sql1, status, order)
-	//if err != nil {
-	//	return err
-	//}
+	err = db.finalizeOrder(ctx, tx, order, AccrualInvalid, 0, nil)
+	if err != nil {
+		return err
+	}
 
 	if err := tx.Commit(ctx); err != nil {
 		return fmt.Errorf("unable to commit: %w", err)
@@ -42,39 +206,118 @@ func (db *DBT) DeferOrder(ctx context.Context, order, status string) error {
 	return nil
 }
 
-func (db *DBT) FinalizeOrder(ctx context.Context, order, status string, accrual float64) error {
+// FinalizeOrder проводит окончательный статус начисления по заказу, захваченному экземпляром workerID.
+// Если срок захвата истек и заказ передан другому экземпляру, статус проведет новый владелец
+func (db *DBT) FinalizeOrder(ctx context.Context, workerID, order, status string, accrual points.Amount, raw []byte) error {
 	tx, err := db.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
+
+	sql := "select 1 from queue where order_num = $1 and claimed_by = $2 for update"
+	var found int
+	err = tx.QueryRow(ctx, sql, order, workerID).Scan(&found)
+	if errors.Is(err, pgx.ErrNoRows) {
+		db.log.Infow("order claim lost, accrual is not finalized", "order", order, "instance", workerID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = db.finalizeOrder(ctx, tx, order, status, accrual, raw)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
+
+// finalizeOrder удаляет заказ из очереди и проводит окончательный статус начисления
+func (db *DBT) finalizeOrder(ctx context.Context, tx pgx.Tx, order, status string, accrual points.Amount, raw []byte) error {
 	db.log.Debugw("finalize accrual", "order", order, "status", status, "accrual", accrual)
 
 	sql := "delete from queue where order_num = $1 returning user_id"
-	resp := db.pool.QueryRow(ctx, sql, order)
+	resp := tx.QueryRow(ctx, sql, order)
 	var userID int
-	err = resp.Scan(&userID)
+	err := resp.Scan(&userID)
 	if err != nil {
 		return err
 	}
 	db.log.Debugw("deleted from queue")
 
-	sql1 := "update accruals set status = $1, accrual = $2 where order_num = $3"
-	_, err = db.pool.Exec(ctx, sql1, status, accrual, order)
+	// начисление с коэффициентом уровня программы лояльности
+	accrual, err = db.applyTier(ctx, tx, userID, accrual)
+	if err != nil {
+		return err
+	}
+
+	sql1 := "update accruals set status = $1, accrual = $2, processed_at = now() where order_num = $3"
+	_, err = tx.Exec(ctx, sql1, status, accrual, order)
+	if err != nil {
+		return err
+	}
+	err = addStatusChange(ctx, tx, order, status, raw)
 	if err != nil {
 		return err
 	}
 	db.log.Debugw("updated accruals")
 
 	sql2 := "update balance set available = available + $1 where user_id = $2"
-	_, err = db.pool.Exec(ctx, sql2, accrual, userID)
+	_, err = tx.Exec(ctx, sql2, accrual, userID)
 	if err != nil {
 		return err
 	}
-	db.log.Debugw("updated balance")
+	if accrual != 0 {
+		err = movePoints(ctx, tx, EntryAccrual, order, systemPosting(accountAccrual, 0), userPosting(userID, 0), accrual)
+		if err != nil {
+			return err
+		}
+		err = db.addLot(ctx, tx, userID, order, accrual)
+		if err != nil {
+			return err
+		}
+		err = db.updateTier(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+	}
 
-	if err := tx.Commit(ctx); err != nil {
-		return fmt.Errorf("unable to commit: %w", err)
+	// бонусы промо-кампаний отдельными проводками
+	var bonus points.Amount
+	if status == AccrualProcessed {
+		bonus, err = db.applyCampaigns(ctx, tx, userID, order, accrual)
+		if err != nil {
+			return err
+		}
+		// бонусы за приглашение после первого обработанного заказа
+		err = db.rewardReferral(ctx, tx, userID, order)
+		if err != nil {
+			return err
+		}
 	}
-	return nil
+	db.log.Debugw("updated balance", "bonus", bonus)
+
+	// уведомления подписчиков (SSE)
+	err = addEvent(ctx, tx, userID, EventOrderStatusChanged, orderStatusEvent{Number: order, Status: status, Accrual: accrual})
+	if err != nil {
+		return err
+	}
+	if accrual != 0 || bonus != 0 {
+		err = addBalanceEvent(ctx, tx, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// событие для вебхуков партнеров (outbox)
+	webhookType := WebhookOrderInvalid
+	if status == AccrualProcessed {
+		webhookType = WebhookOrderProcessed
+	}
+	return addWebhookEvent(ctx, tx, webhookType, orderWebhookEvent{Order: order, Status: status, Accrual: accrual, ProcessedAt: time.Now().Format(time.RFC3339)})
 }
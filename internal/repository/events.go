@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// размер страницы событий, отдаваемых при переподключении по Last-Event-ID
+const maxReplayEvents = 1000
+
+// addEvent сохраняет событие пользователя в рамках транзакции tx.
+// pg_notify внутри транзакции доставляется слушателям только после commit
+func addEvent(ctx context.Context, tx pgx.Tx, userID int, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	e := Event{UserID: userID, Type: eventType, Data: payload}
+	sql := "insert into user_events (user_id, event_type, payload) values ($1, $2, $3) returning id, created_at;"
+	err = tx.QueryRow(ctx, sql, userID, eventType, string(payload)).Scan(&e.ID, &e.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	msg, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	sql1 := "select pg_notify($1, $2);"
+	_, err = tx.Exec(ctx, sql1, EventsChannel, string(msg))
+	return err
+}
+
+// addBalanceEvent отправляет событие с актуальным балансом пользователя
+func addBalanceEvent(ctx context.Context, tx pgx.Tx, userID int) error {
+	sql := "select available, withdrawn from balance where user_id = $1;"
+	bal := Balance{}
+	err := tx.QueryRow(ctx, sql, userID).Scan(&bal.Current, &bal.Withdrawn)
+	if err != nil {
+		return err
+	}
+	return addEvent(ctx, tx, userID, EventBalanceChanged, bal)
+}
+
+// EventsAfter возвращает страницу событий пользователя после lastID. Следующая страница
+// запрашивается с id последнего события, пустая страница - события прочитаны
+func (db *DBT) EventsAfter(ctx context.Context, userID int, lastID int64) ([]Event, error) {
+	sql := "select id, event_type, payload, created_at from user_events where user_id = $1 and id > $2 order by id limit $3;"
+	rows, err := db.pool.Query(ctx, sql, userID, lastID, maxReplayEvents)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]Event, 0, 10)
+	for rows.Next() {
+		e := Event{UserID: userID}
+		var payload string
+		err = rows.Scan(&e.ID, &e.Type, &payload, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		e.Data = json.RawMessage(payload)
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
+
+// DeleteEventsBefore удаляет события пользователей старше ttl: после этого срока клиент
+// не получит их при переподключении. Возвращает количество удаленных событий
+func (db *DBT) DeleteEventsBefore(ctx context.Context, ttl time.Duration) (int, error) {
+	sql := "delete from user_events where created_at < now() - make_interval(secs => $1);"
+	tag, err := db.pool.Exec(ctx, sql, ttl.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// Listen подписывается на канал Postgres LISTEN/NOTIFY на выделенном соединении
+// и вызывает fn для каждого уведомления до отмены контекста
+func (db *DBT) Listen(ctx context.Context, channel string, fn func(payload string)) error {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	_, err = conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize())
+	if err != nil {
+		return err
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(n.Payload)
+	}
+}
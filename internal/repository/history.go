@@ -0,0 +1,62 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// addStatusChange записывает переход статуса заказа вместе с ответом системы начислений
+func addStatusChange(ctx context.Context, tx pgx.Tx, order, status string, raw []byte) error {
+	var rawResponse interface{}
+	if len(raw) > 0 {
+		rawResponse = string(raw)
+	}
+	sql := "insert into order_status_history (order_num, status, raw_response) values ($1, $2, $3);"
+	_, err := tx.Exec(ctx, sql, order, status, rawResponse)
+	return err
+}
+
+func (db *DBT) GetOrder(ctx context.Context, userID int, order string) (OrderDetails, error) {
+	res := OrderDetails{}
+	item := &res.orderItem
+
+	sql := "select a.order_num, a.status, a.accrual, a.uploaded_at, a.processed_at from accruals a\n" +
+		"join orders o on o.order_num = a.order_num where a.order_num = $1 and o.user_id = $2;"
+	err := db.pool.QueryRow(ctx, sql, order, userID).Scan(&item.Number, &item.Status, &item.Accrual, &item.UploadedAtGo, &item.ProcessedAtGo)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return res, ErrOrderNotFound
+	}
+	if err != nil {
+		return res, err
+	}
+	item.UploadedAt = item.UploadedAtGo.Format(time.RFC3339)
+	if item.ProcessedAtGo != nil {
+		item.ProcessedAt = item.ProcessedAtGo.Format(time.RFC3339)
+	}
+
+	sql1 := "select status, changed_at, coalesce(raw_response::text, '') from order_status_history where order_num = $1 order by id;"
+	rows, err := db.pool.Query(ctx, sql1, order)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	res.History = make([]statusChange, 0, 4)
+	for rows.Next() {
+		ch := statusChange{}
+		var raw string
+		err = rows.Scan(&ch.Status, &ch.ChangedAtGo, &raw)
+		if err != nil {
+			return res, err
+		}
+		ch.ChangedAt = ch.ChangedAtGo.Format(time.RFC3339)
+		if raw != "" {
+			ch.Raw = json.RawMessage(raw)
+		}
+		res.History = append(res.History, ch)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,311 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v4"
+)
+
+// количество просроченных резервов, снимаемых за одну транзакцию
+const expireHoldsBatchSize = 100
+
+const holdColumns = "id, order_num, amount, status, created_at, expires_at, resolved_at"
+
+func scanHold(row pgx.Row) (Hold, error) {
+	h := Hold{}
+	err := row.Scan(&h.ID, &h.Order, &h.Amount, &h.Status, &h.CreatedAtGo, &h.ExpiresAtGo, &h.ResolvedAtGo)
+	if err != nil {
+		return h, err
+	}
+	h.formatTimes()
+	return h, nil
+}
+
+// CreateHold резервирует sum баллов под оплату заказа order на сумму orderTotal на ttl секунд.
+// Баллы переносятся со счета пользователя на счет резерва и недоступны для других списаний.
+// К резерву применяются ограничения списаний
+func (db *DBT) CreateHold(ctx context.Context, userID int, order string, sum, orderTotal points.Amount, ttl int64) (Hold, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// номер заказа резервируется до списания или отмены резерва: заказ не должен быть уже оплачен
+	// или загружен для начисления, и его нельзя загрузить или оплатить, пока резерв действует
+	err = addWithdrawalOrder(ctx, tx, userID, order)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	sql := "insert into holds (user_id, order_num, amount, expires_at) values ($1, $2, $3, now() + make_interval(secs => $4))\n" +
+		"returning " + holdColumns + ";"
+	h, err := scanHold(tx.QueryRow(ctx, sql, userID, order, sum, ttl))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation {
+		return Hold{}, ErrOrderAlreadyExists
+	}
+	if err != nil {
+		return Hold{}, err
+	}
+
+	// резерв списывается из партий сразу: зарезервированные баллы не сгорают
+	parts, err := consumeLots(ctx, tx, userID, sum)
+	if err != nil {
+		return Hold{}, err
+	}
+	err = recordLotUsages(ctx, tx, parts, "", h.ID)
+	if err != nil {
+		return Hold{}, err
+	}
+	err = db.checkWithdrawalLimits(ctx, tx, userID, sum, orderTotal)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	sql1 := "update balance set available = available - $1, held = held + $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql1, sum, userID)
+	if errors.As(err, &pgErr) && pgErr.Code == pgerrcode.CheckViolation {
+		return Hold{}, ErrNotEnoughFunds
+	}
+	if err != nil {
+		return Hold{}, err
+	}
+	err = movePoints(ctx, tx, EntryHold, order, userPosting(userID, 0), holdPosting(h.ID, userID, 0), sum)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	err = addBalanceEvent(ctx, tx, userID)
+	if err != nil {
+		return Hold{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return Hold{}, fmt.Errorf("unable to commit: %w", err)
+	}
+	return h, nil
+}
+
+// CaptureHold списывает зарезервированные баллы в оплату заказа - так же, как WithdrawToOrder
+func (db *DBT) CaptureHold(ctx context.Context, userID int, holdID int64) (Hold, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	h, err := lockActiveHold(ctx, tx, userID, holdID)
+	if err != nil {
+		return h, err
+	}
+
+	// номер заказа зарезервирован в orders при создании резерва
+	sql := "update balance set held = held - $1, withdrawn = withdrawn + $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql, h.Amount, userID)
+	if err != nil {
+		return h, err
+	}
+	err = movePoints(ctx, tx, EntryWithdrawal, h.Order, holdPosting(h.ID, userID, 0), systemPosting(accountRedemption, 0), h.Amount)
+	if err != nil {
+		return h, err
+	}
+	err = addWithdrawal(ctx, tx, userID, h.Order, h.Amount)
+	if err != nil {
+		return h, err
+	}
+	// партии резерва переходят к списанию - для возврата баллов
+	_, err = tx.Exec(ctx, "update lot_usages set withdrawal_order = $1 where hold_id = $2;", h.Order, h.ID)
+	if err != nil {
+		return h, err
+	}
+
+	h, err = resolveHold(ctx, tx, h.ID, HoldCaptured)
+	if err != nil {
+		return h, err
+	}
+	err = addBalanceEvent(ctx, tx, userID)
+	if err != nil {
+		return h, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return h, fmt.Errorf("unable to commit: %w", err)
+	}
+	return h, nil
+}
+
+// VoidHold отменяет резерв и возвращает баллы на счет пользователя
+func (db *DBT) VoidHold(ctx context.Context, userID int, holdID int64) (Hold, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return Hold{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	h, err := lockActiveHold(ctx, tx, userID, holdID)
+	if err != nil {
+		return h, err
+	}
+	h, err = db.releaseHold(ctx, tx, userID, h, HoldVoided)
+	if err != nil {
+		return h, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return h, fmt.Errorf("unable to commit: %w", err)
+	}
+	return h, nil
+}
+
+// GetHolds возвращает резервы пользователя, новые первыми
+func (db *DBT) GetHolds(ctx context.Context, userID int) ([]Hold, error) {
+	sql := "select " + holdColumns + " from holds where user_id = $1 order by id desc;"
+	rows, err := db.pool.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]Hold, 0, 4)
+	for rows.Next() {
+		h, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, h)
+	}
+	return res, rows.Err()
+}
+
+// ExpireHolds снимает просроченные резервы. Возвращает количество снятых резервов
+func (db *DBT) ExpireHolds(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := db.expireHoldsBatch(ctx)
+		total += n
+		if err != nil || n < expireHoldsBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (db *DBT) expireHoldsBatch(ctx context.Context) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := "select user_id, " + holdColumns + " from holds where status = $1 and expires_at <= now()\n" +
+		"order by id limit $2 for update skip locked;"
+	rows, err := tx.Query(ctx, sql, HoldActive, expireHoldsBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type userHold struct {
+		userID int
+		hold   Hold
+	}
+	holds := make([]userHold, 0, expireHoldsBatchSize)
+	for rows.Next() {
+		uh := userHold{}
+		h := &uh.hold
+		err = rows.Scan(&uh.userID, &h.ID, &h.Order, &h.Amount, &h.Status, &h.CreatedAtGo, &h.ExpiresAtGo, &h.ResolvedAtGo)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		holds = append(holds, uh)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, uh := range holds {
+		_, err = db.releaseHold(ctx, tx, uh.userID, uh.hold, HoldExpired)
+		if err != nil {
+			return 0, err
+		}
+		db.log.Debugw("hold expired", "userID", uh.userID, "hold", uh.hold.ID, "order", uh.hold.Order, "amount", uh.hold.Amount)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("unable to commit: %w", err)
+	}
+	return len(holds), nil
+}
+
+// lockActiveHold блокирует действующий резерв пользователя. Просроченный, но еще не снятый
+// резерв недействителен: его снимет ExpireHolds
+func lockActiveHold(ctx context.Context, tx pgx.Tx, userID int, holdID int64) (Hold, error) {
+	sql := "select " + holdColumns + " from holds where id = $1 and user_id = $2 for update;"
+	h, err := scanHold(tx.QueryRow(ctx, sql, holdID, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return h, ErrHoldNotFound
+	}
+	if err != nil {
+		return h, err
+	}
+	if h.Status != HoldActive {
+		return h, ErrHoldNotActive
+	}
+
+	var expired bool
+	err = tx.QueryRow(ctx, "select expires_at <= now() from holds where id = $1;", h.ID).Scan(&expired)
+	if err != nil {
+		return h, err
+	}
+	if expired {
+		return h, ErrHoldNotActive
+	}
+	return h, nil
+}
+
+// releaseHold возвращает баллы резерва на счет пользователя и закрывает резерв со статусом status.
+// Баллы возвращаются в партии, из которых были зарезервированы, с прежним сроком сгорания;
+// остаток без партий сгорает как новое начисление
+func (db *DBT) releaseHold(ctx context.Context, tx pgx.Tx, userID int, h Hold, status string) (Hold, error) {
+	lotRest, err := restoreLots(ctx, tx, "u.hold_id = $1", h.ID, h.Amount)
+	if err != nil {
+		return h, err
+	}
+	err = db.addLot(ctx, tx, userID, h.Order, lotRest)
+	if err != nil {
+		return h, err
+	}
+	sql := "update balance set available = available + $1, held = held - $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql, h.Amount, userID)
+	if err != nil {
+		return h, err
+	}
+	err = movePoints(ctx, tx, EntryRelease, h.Order, holdPosting(h.ID, userID, 0), userPosting(userID, 0), h.Amount)
+	if err != nil {
+		return h, err
+	}
+	// номер заказа снова свободен. Строка удаляется, только если это резерв номера без начислений и списаний
+	sql1 := "delete from orders o where o.order_num = $1 and o.user_id = $2\n" +
+		"and not exists (select 1 from accruals a where a.order_num = o.order_num)\n" +
+		"and not exists (select 1 from withdrawns w where w.order_num = o.order_num);"
+	_, err = tx.Exec(ctx, sql1, h.Order, userID)
+	if err != nil {
+		return h, err
+	}
+
+	h, err = resolveHold(ctx, tx, h.ID, status)
+	if err != nil {
+		return h, err
+	}
+	return h, addBalanceEvent(ctx, tx, userID)
+}
+
+func resolveHold(ctx context.Context, tx pgx.Tx, holdID int64, status string) (Hold, error) {
+	sql := "update holds set status = $1, resolved_at = now() where id = $2 returning " + holdColumns + ";"
+	return scanHold(tx.QueryRow(ctx, sql, status, holdID))
+}
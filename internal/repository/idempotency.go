@@ -0,0 +1,76 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ReserveIdempotencyKey резервирует ключ запроса пользователя на время lease: если ответ не сохранен
+// за это время (экземпляр сервиса остановился), ключ освобождается. Если ключ уже использовался,
+// возвращает сохраненный ответ (reserved = false). Ключ с другим хешем запроса - ErrIdempotencyKeyMismatch,
+// ключ запроса, который еще выполняется - ErrIdempotencyKeyInProgress
+func (db *DBT) ReserveIdempotencyKey(ctx context.Context, userID int, key, requestHash string, lease time.Duration) (resp IdempotentResponse, reserved bool, err error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return resp, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	// ключи с истекшим сроком хранения или резервирования больше не действуют
+	sql := "delete from idempotency_keys where user_id = $1 and expires_at < now();"
+	_, err = tx.Exec(ctx, sql, userID)
+	if err != nil {
+		return resp, false, err
+	}
+
+	sql1 := "insert into idempotency_keys (user_id, key, request_hash, expires_at) values ($1, $2, $3, now() + make_interval(secs => $4))\non conflict do nothing;"
+	tag, err := tx.Exec(ctx, sql1, userID, key, requestHash, lease.Seconds())
+	if err != nil {
+		return resp, false, err
+	}
+
+	if tag.RowsAffected() == 0 {
+		sql2 := "select request_hash, status_code, coalesce(content_type, ''), coalesce(response_body, ''::bytea) from idempotency_keys where user_id = $1 and key = $2;"
+		var hash string
+		err = tx.QueryRow(ctx, sql2, userID, key).Scan(&hash, &resp.StatusCode, &resp.ContentType, &resp.Body)
+		if err != nil {
+			return resp, false, err
+		}
+		if hash != requestHash {
+			return resp, false, ErrIdempotencyKeyMismatch
+		}
+		if resp.StatusCode == 0 {
+			return resp, false, ErrIdempotencyKeyInProgress
+		}
+		return resp, false, nil
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return resp, false, fmt.Errorf("unable to commit: %w", err)
+	}
+	return resp, true, nil
+}
+
+// SaveIdempotentResponse сохраняет ответ на запрос по ключу на срок ttl
+func (db *DBT) SaveIdempotentResponse(ctx context.Context, userID int, key string, resp IdempotentResponse, ttl time.Duration) error {
+	sql := "update idempotency_keys set status_code = $1, content_type = $2, response_body = $3, expires_at = now() + make_interval(secs => $4)\n" +
+		"where user_id = $5 and key = $6;"
+	_, err := db.pool.Exec(ctx, sql, resp.StatusCode, resp.ContentType, resp.Body, ttl.Seconds(), userID, key)
+	if err != nil {
+		// запрос уже выполнен, но повтор до истечения резервирования получит 409, а после - выполнит его снова
+		db.log.Errorw("unable to save idempotent response", "userID", userID, "key", key, "status", resp.StatusCode, "error", err)
+	}
+	return err
+}
+
+// ReleaseIdempotencyKey освобождает ключ, чтобы запрос можно было повторить (например, после 5xx)
+func (db *DBT) ReleaseIdempotencyKey(ctx context.Context, userID int, key string) error {
+	sql := "delete from idempotency_keys where user_id = $1 and key = $2;"
+	_, err := db.pool.Exec(ctx, sql, userID, key)
+	if err != nil {
+		// повтор запроса получит 409 до истечения резервирования ключа
+		db.log.Errorw("unable to release idempotency key", "userID", userID, "key", key, "error", err)
+	}
+	return err
+}
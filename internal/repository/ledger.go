@@ -0,0 +1,98 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+)
+
+// счета журнала баллов. У каждого пользователя свой счет user:<id>,
+// системные счета - источники и получатели баллов
+const (
+	accountAccrual    = "system:accrual"
+	accountRedemption = "system:redemption"
+	accountOpening    = "system:opening"
+	accountCorrection = "system:correction"
+	accountExpired    = "system:expired"
+	accountReferral   = "system:referral"
+)
+
+// типы проводок журнала
+const (
+	EntryOpening       = "opening"
+	EntryAccrual       = "accrual"
+	EntryWithdrawal    = "withdrawal"
+	EntryCorrection    = "correction"
+	EntryExpiration    = "expiration"
+	EntryTransfer      = "transfer"
+	EntryRefund        = "refund"
+	EntryHold          = "hold"
+	EntryRelease       = "release"
+	EntryCampaignBonus = "campaign_bonus"
+	EntryReferralBonus = "referral_bonus"
+)
+
+type posting struct {
+	account string
+	userID  int
+	amount  points.Amount
+}
+
+func userAccount(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// holdAccount - счет резерва баллов. Проводки по нему относятся к пользователю-владельцу
+func holdAccount(holdID int64) string {
+	return fmt.Sprintf("hold:%d", holdID)
+}
+
+func holdPosting(holdID int64, userID int, amount points.Amount) posting {
+	return posting{account: holdAccount(holdID), userID: userID, amount: amount}
+}
+
+func userPosting(userID int, amount points.Amount) posting {
+	return posting{account: userAccount(userID), userID: userID, amount: amount}
+}
+
+func systemPosting(account string, amount points.Amount) posting {
+	return posting{account: account, amount: amount}
+}
+
+// movePoints проводит перемещение amount баллов со счета from на счет to
+func movePoints(ctx context.Context, tx pgx.Tx, entryType, order string, from, to posting, amount points.Amount) error {
+	from.amount, to.amount = -amount, amount
+	return postLedger(ctx, tx, entryType, order, from, to)
+}
+
+// postLedger записывает сбалансированную транзакцию журнала: сумма проводок должна быть равна нулю.
+// Баланс дополнительно проверяется триггером при commit
+func postLedger(ctx context.Context, tx pgx.Tx, entryType, order string, postings ...posting) error {
+	var sum points.Amount
+	for _, p := range postings {
+		sum += p.amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("unbalanced ledger transaction: %s, sum %v", entryType, sum)
+	}
+
+	var txID int64
+	err := tx.QueryRow(ctx, "select nextval('ledger_tx_seq');").Scan(&txID)
+	if err != nil {
+		return err
+	}
+
+	var orderNum interface{}
+	if order != "" {
+		orderNum = order
+	}
+	sql := "insert into ledger_entries (tx_id, account, user_id, amount, entry_type, order_num) values ($1, $2, nullif($3, 0), $4, $5, $6);"
+	for _, p := range postings {
+		_, err = tx.Exec(ctx, sql, txID, p.account, p.userID, p.amount, entryType, orderNum)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
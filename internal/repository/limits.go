@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"context"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+)
+
+// имена правил ограничения списаний
+const (
+	RuleMaxPerWithdrawal = "max_per_withdrawal"
+	RuleDailyLimit       = "daily_limit"
+	RuleWeeklyLimit      = "weekly_limit"
+	RuleMinAccountAge    = "min_account_age"
+	RuleMaxOrderShare    = "max_order_share"
+)
+
+// WithdrawalLimits - ограничения списаний баллов. Нулевое значение - ограничение не действует
+type WithdrawalLimits struct {
+	MaxPerWithdrawal points.Amount
+	Daily            points.Amount
+	Weekly           points.Amount
+	// минимальный возраст учетной записи в часах
+	MinAccountAge int64
+	// максимальная доля суммы заказа, оплачиваемая баллами, в процентах
+	MaxOrderShare int64
+}
+
+// SetWithdrawalLimits задает ограничения списаний
+func (db *DBT) SetWithdrawalLimits(l WithdrawalLimits) {
+	db.limits = l
+}
+
+// checkWithdrawalLimits проверяет ограничения списания sum в оплату заказа на сумму orderTotal.
+// Строка balance блокируется, поэтому параллельные списания пользователя проверяются по очереди.
+// Вызывается после consumeLots - партии блокируются раньше строки balance
+func (db *DBT) checkWithdrawalLimits(ctx context.Context, tx pgx.Tx, userID int, sum, orderTotal points.Amount) error {
+	l := db.limits
+	if l.MaxPerWithdrawal > 0 && sum > l.MaxPerWithdrawal {
+		return &LimitError{Rule: RuleMaxPerWithdrawal}
+	}
+	if l.MaxOrderShare > 0 {
+		if orderTotal <= 0 {
+			return ErrOrderTotalRequired
+		}
+		if int64(sum)*100 > int64(orderTotal)*l.MaxOrderShare {
+			return &LimitError{Rule: RuleMaxOrderShare}
+		}
+	}
+	if l.Daily <= 0 && l.Weekly <= 0 && l.MinAccountAge <= 0 {
+		return nil
+	}
+
+	var tooYoung bool
+	sql := "select u.registered_at > now() - make_interval(hours => $2) from balance b\n" +
+		"join users u on u.user_id = b.user_id where b.user_id = $1 for update of b;"
+	err := tx.QueryRow(ctx, sql, userID, l.MinAccountAge).Scan(&tooYoung)
+	if err != nil {
+		return err
+	}
+	if l.MinAccountAge > 0 && tooYoung {
+		return &LimitError{Rule: RuleMinAccountAge}
+	}
+
+	// списания и действующие резервы за текущие сутки и неделю
+	var daily, weekly points.Amount
+	sql1 := "select coalesce(sum(amount) filter (where at >= date_trunc('day', now())), 0), coalesce(sum(amount), 0) from (\n" +
+		"select w.withdrawn as amount, w.processed_at as at from withdrawns w join orders o on o.order_num = w.order_num\n" +
+		"where o.user_id = $1 and w.processed_at >= date_trunc('week', now())\n" +
+		"union all\n" +
+		"select amount, created_at from holds where user_id = $1 and status = $2 and created_at >= date_trunc('week', now())\n" +
+		") s;"
+	err = tx.QueryRow(ctx, sql1, userID, HoldActive).Scan(&daily, &weekly)
+	if err != nil {
+		return err
+	}
+	if l.Daily > 0 && daily+sum > l.Daily {
+		return &LimitError{Rule: RuleDailyLimit}
+	}
+	if l.Weekly > 0 && weekly+sum > l.Weekly {
+		return &LimitError{Rule: RuleWeeklyLimit}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+const (
+	// количество сгорающих партий за одну транзакцию
+	expireBatchSize = 100
+	// количество ближайших дат сгорания в балансе
+	maxExpiringItems = 10
+)
+
+// SetPointsLifetime задает срок жизни начисленных баллов в месяцах. 0 - баллы не сгорают
+func (db *DBT) SetPointsLifetime(months int) {
+	db.pointsLifetime = months
+}
+
+// addLot создает партию начисленных баллов со сроком сгорания, если он задан
+func (db *DBT) addLot(ctx context.Context, tx pgx.Tx, userID int, order string, amount points.Amount) error {
+	if db.pointsLifetime <= 0 || amount <= 0 {
+		return nil
+	}
+	sql := "insert into point_lots (user_id, order_num, amount, remaining, expires_at) values ($1, nullif($2, ''), $3, $3, now() + make_interval(months => $4));"
+	_, err := tx.Exec(ctx, sql, userID, order, amount, db.pointsLifetime)
+	return err
+}
+
+// lotPart - часть партии, списанная consumeLots
+type lotPart struct {
+	lotID     int64
+	amount    points.Amount
+	expiresAt time.Time
+}
+
+// addLotUntil создает партию баллов с заданным сроком сгорания - для баллов, перешедших из партий
+// другого пользователя: срок жизни баллов при переводе не продлевается
+func addLotUntil(ctx context.Context, tx pgx.Tx, userID int, order string, amount points.Amount, expiresAt time.Time) error {
+	sql := "insert into point_lots (user_id, order_num, amount, remaining, expires_at) values ($1, nullif($2, ''), $3, $3, $4);"
+	_, err := tx.Exec(ctx, sql, userID, order, amount, expiresAt)
+	return err
+}
+
+// consumeLots списывает amount из партий пользователя в порядке сгорания (FIFO) и возвращает
+// списанные части партий. Баллы вне партий (начисленные до ввода сгорания) списываются после партий.
+// Партии блокируются до строки balance - в том же порядке, что и при сгорании
+func consumeLots(ctx context.Context, tx pgx.Tx, userID int, amount points.Amount) ([]lotPart, error) {
+	sql := "select id, remaining, expires_at from point_lots where user_id = $1 and remaining > 0 and expired_at is null order by expires_at, id for update;"
+	rows, err := tx.Query(ctx, sql, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	type lot struct {
+		id        int64
+		remaining points.Amount
+		expiresAt time.Time
+	}
+	lots := make([]lot, 0, 4)
+	for rows.Next() {
+		l := lot{}
+		err = rows.Scan(&l.id, &l.remaining, &l.expiresAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		lots = append(lots, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	parts := make([]lotPart, 0, len(lots))
+	sql1 := "update point_lots set remaining = remaining - $1 where id = $2;"
+	for _, l := range lots {
+		if amount <= 0 {
+			break
+		}
+		take := l.remaining
+		if take > amount {
+			take = amount
+		}
+		_, err = tx.Exec(ctx, sql1, take, l.id)
+		if err != nil {
+			return nil, err
+		}
+		amount -= take
+		parts = append(parts, lotPart{lotID: l.id, amount: take, expiresAt: l.expiresAt})
+	}
+	return parts, nil
+}
+
+// recordLotUsages запоминает, из каких партий оплачено списание на заказ order или резерв holdID
+// (0 - не резерв), чтобы при возврате баллов вернуть их в те же партии
+func recordLotUsages(ctx context.Context, tx pgx.Tx, parts []lotPart, order string, holdID int64) error {
+	sql := "insert into lot_usages (lot_id, withdrawal_order, hold_id, amount) values ($1, nullif($2, ''), nullif($3::bigint, 0), $4);"
+	for _, part := range parts {
+		_, err := tx.Exec(ctx, sql, part.lotID, order, holdID, part.amount)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreLots возвращает до amount баллов в партии, из которых они были списаны (filter - условие
+// отбора строк lot_usages u), начиная с ранее сгорающих. Исходный срок сгорания сохраняется:
+// если он уже истек, возвращенные баллы сгорят при ближайшем запуске сгорания.
+// Возвращает сумму, для которой партии не найдены
+func restoreLots(ctx context.Context, tx pgx.Tx, filter string, arg interface{}, amount points.Amount) (points.Amount, error) {
+	sql := "select u.id, u.lot_id, u.amount - u.restored from lot_usages u join point_lots l on l.id = u.lot_id\n" +
+		"where " + filter + " and u.restored < u.amount order by l.expires_at, l.id for update of u;"
+	rows, err := tx.Query(ctx, sql, arg)
+	if err != nil {
+		return amount, err
+	}
+
+	type usage struct {
+		id    int64
+		lotID int64
+		rest  points.Amount
+	}
+	usages := make([]usage, 0, 4)
+	for rows.Next() {
+		u := usage{}
+		err = rows.Scan(&u.id, &u.lotID, &u.rest)
+		if err != nil {
+			rows.Close()
+			return amount, err
+		}
+		usages = append(usages, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return amount, err
+	}
+
+	sql1 := "update point_lots set remaining = remaining + $1, expired_at = null where id = $2;"
+	sql2 := "update lot_usages set restored = restored + $1 where id = $2;"
+	for _, u := range usages {
+		if amount <= 0 {
+			break
+		}
+		take := u.rest
+		if take > amount {
+			take = amount
+		}
+		_, err = tx.Exec(ctx, sql1, take, u.lotID)
+		if err != nil {
+			return amount, err
+		}
+		_, err = tx.Exec(ctx, sql2, take, u.id)
+		if err != nil {
+			return amount, err
+		}
+		amount -= take
+	}
+	return amount, nil
+}
+
+// ExpireLots списывает остатки партий, срок которых истек. Возвращает количество сгоревших партий
+func (db *DBT) ExpireLots(ctx context.Context) (int, error) {
+	total := 0
+	for {
+		n, err := db.expireBatch(ctx)
+		total += n
+		if err != nil || n < expireBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (db *DBT) expireBatch(ctx context.Context) (int, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := "select id, user_id, order_num, remaining from point_lots\n" +
+		"where remaining > 0 and expired_at is null and expires_at <= now()\n" +
+		"order by user_id, id limit $1 for update skip locked;"
+	rows, err := tx.Query(ctx, sql, expireBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type lot struct {
+		id        int64
+		userID    int
+		order     string
+		remaining points.Amount
+	}
+	lots := make([]lot, 0, expireBatchSize)
+	for rows.Next() {
+		l := lot{}
+		err = rows.Scan(&l.id, &l.userID, &l.order, &l.remaining)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		lots = append(lots, l)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	changed := make(map[int]bool)
+	for _, l := range lots {
+		// сгорает не больше доступного остатка
+		var available points.Amount
+		sql1 := "select available from balance where user_id = $1 for update;"
+		err = tx.QueryRow(ctx, sql1, l.userID).Scan(&available)
+		if err != nil {
+			return 0, err
+		}
+		amount := l.remaining
+		if amount > available {
+			amount = available
+		}
+
+		if amount > 0 {
+			sql2 := "update balance set available = available - $1 where user_id = $2;"
+			_, err = tx.Exec(ctx, sql2, amount, l.userID)
+			if err != nil {
+				return 0, err
+			}
+			err = movePoints(ctx, tx, EntryExpiration, l.order, userPosting(l.userID, 0), systemPosting(accountExpired, 0), amount)
+			if err != nil {
+				return 0, err
+			}
+			changed[l.userID] = true
+		}
+
+		sql3 := "update point_lots set remaining = 0, expired_at = now() where id = $1;"
+		_, err = tx.Exec(ctx, sql3, l.id)
+		if err != nil {
+			return 0, err
+		}
+		db.log.Debugw("points expired", "userID", l.userID, "order", l.order, "amount", amount)
+	}
+
+	for userID := range changed {
+		err = addBalanceEvent(ctx, tx, userID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("unable to commit: %w", err)
+	}
+	return len(lots), nil
+}
+
+// expiringPoints возвращает ближайшие даты сгорания баллов пользователя
+func (db *DBT) expiringPoints(ctx context.Context, userID int) ([]Expiration, error) {
+	sql := "select sum(remaining), expires_at from point_lots where user_id = $1 and remaining > 0 and expired_at is null\n" +
+		"group by expires_at order by expires_at limit $2;"
+	rows, err := db.pool.Query(ctx, sql, userID, maxExpiringItems)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []Expiration
+	for rows.Next() {
+		e := Expiration{}
+		var at time.Time
+		err = rows.Scan(&e.Amount, &at)
+		if err != nil {
+			return nil, err
+		}
+		e.At = at.Format(time.RFC3339)
+		res = append(res, e)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists user_events
+(
+    id bigserial primary key,
+    user_id integer,
+    event_type varchar(64),
+    payload jsonb,
+    created_at timestamp default now(),
+    foreign key (user_id) references users (user_id) on delete cascade
+);
+
+create index if not exists user_events_user_id_idx on user_events (user_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists user_events;
+-- +goose StatementEnd
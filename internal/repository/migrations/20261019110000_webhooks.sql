@@ -0,0 +1,55 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists webhook_subscriptions
+(
+    id serial primary key,
+    partner varchar(64),
+    url text,
+    event_types text[],
+    secret varchar(128),
+    active boolean default true,
+    created_at timestamp default now()
+);
+
+create table if not exists webhook_outbox
+(
+    id bigserial primary key,
+    event_type varchar(64),
+    payload jsonb,
+    created_at timestamp default now()
+);
+
+create table if not exists webhook_deliveries
+(
+    id bigserial primary key,
+    outbox_id bigint,
+    subscription_id integer,
+    status varchar(16) default 'PENDING',
+    attempts integer default 0,
+    next_attempt_at timestamp default now(),
+    last_error text,
+    delivered_at timestamp,
+    created_at timestamp default now(),
+    foreign key (outbox_id) references webhook_outbox (id) on delete cascade,
+    foreign key (subscription_id) references webhook_subscriptions (id) on delete cascade
+);
+
+create index if not exists webhook_deliveries_pending_idx on webhook_deliveries (next_attempt_at) where status = 'PENDING';
+
+create table if not exists webhook_delivery_log
+(
+    id bigserial primary key,
+    delivery_id bigint,
+    attempt integer,
+    response_code integer,
+    error text,
+    duration_ms integer,
+    created_at timestamp default now(),
+    foreign key (delivery_id) references webhook_deliveries (id) on delete cascade
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists webhook_delivery_log, webhook_deliveries, webhook_outbox, webhook_subscriptions;
+-- +goose StatementEnd
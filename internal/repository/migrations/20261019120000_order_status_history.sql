@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists order_status_history
+(
+    id bigserial primary key,
+    order_num varchar(32),
+    status varchar(16),
+    raw_response jsonb,
+    changed_at timestamp default now(),
+    foreign key (order_num) references orders (order_num) on delete cascade
+);
+
+create index if not exists order_status_history_order_idx on order_status_history (order_num, id);
+
+alter table accruals add column if not exists processed_at timestamp;
+
+-- история для уже загруженных заказов начинается с момента загрузки
+insert into order_status_history (order_num, status, changed_at)
+select order_num, 'NEW', uploaded_at from accruals;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table accruals drop column if exists processed_at;
+drop table if exists order_status_history;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists idempotency_keys
+(
+    user_id integer,
+    key varchar(255),
+    request_hash char(64),
+    status_code integer default 0,
+    content_type varchar(128),
+    response_body bytea,
+    created_at timestamp default now(),
+    expires_at timestamp,
+    primary key (user_id, key),
+    foreign key (user_id) references users (user_id) on delete cascade
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists idempotency_keys;
+-- +goose StatementEnd
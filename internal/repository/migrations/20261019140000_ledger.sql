@@ -0,0 +1,74 @@
+-- +goose Up
+-- +goose StatementBegin
+create sequence if not exists ledger_tx_seq;
+
+create table if not exists ledger_entries
+(
+    id bigserial primary key,
+    tx_id bigint not null,
+    account varchar(64) not null,
+    user_id integer,
+    amount numeric(12,2) not null,
+    entry_type varchar(32) not null,
+    order_num varchar(32),
+    created_at timestamp default now()
+);
+
+create index if not exists ledger_entries_account_idx on ledger_entries (account, created_at);
+create index if not exists ledger_entries_tx_idx on ledger_entries (tx_id);
+
+-- сумма проводок одной транзакции равна нулю (проверяется при commit)
+create or replace function ledger_check_balanced() returns trigger as $$
+begin
+    if (select sum(amount) from ledger_entries where tx_id = new.tx_id) <> 0 then
+        raise exception 'unbalanced ledger transaction %', new.tx_id;
+    end if;
+    return null;
+end;
+$$ language plpgsql;
+
+create constraint trigger ledger_entries_balanced after insert on ledger_entries
+    deferrable initially deferred for each row execute procedure ledger_check_balanced();
+
+-- журнал только дописывается
+create or replace function ledger_append_only() returns trigger as $$
+begin
+    raise exception 'ledger entries are append-only';
+end;
+$$ language plpgsql;
+
+create trigger ledger_entries_append_only before update or delete on ledger_entries
+    for each row execute procedure ledger_append_only();
+
+-- списания, сделанные до ввода журнала
+with w as (
+    select nextval('ledger_tx_seq') as tx_id, o.user_id, w.order_num, w.withdrawn, w.processed_at
+    from withdrawns w join orders o on o.order_num = w.order_num
+)
+insert into ledger_entries (tx_id, account, user_id, amount, entry_type, order_num, created_at)
+select tx_id, 'user:' || user_id, user_id, -withdrawn, 'withdrawal', order_num, processed_at from w
+union all
+select tx_id, 'system:redemption', null, withdrawn, 'withdrawal', order_num, processed_at from w;
+
+-- входящие остатки: текущий баланс плюс уже списанные баллы
+with b as (
+    select nextval('ledger_tx_seq') as tx_id, user_id, amount, registered_at
+    from (
+        select b.user_id, coalesce(u.registered_at, now()) as registered_at,
+               b.available + coalesce((select sum(w.withdrawn) from withdrawns w join orders o on o.order_num = w.order_num where o.user_id = b.user_id), 0) as amount
+        from balance b join users u on u.user_id = b.user_id
+    ) s
+    where amount <> 0
+)
+insert into ledger_entries (tx_id, account, user_id, amount, entry_type, created_at)
+select tx_id, 'user:' || user_id, user_id, amount, 'opening', registered_at from b
+union all
+select tx_id, 'system:opening', null, -amount, 'opening', registered_at from b;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists ledger_entries;
+drop function if exists ledger_check_balanced, ledger_append_only;
+drop sequence if exists ledger_tx_seq;
+-- +goose StatementEnd
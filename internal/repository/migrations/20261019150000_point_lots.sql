@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists point_lots
+(
+    id bigserial primary key,
+    user_id integer,
+    order_num varchar(32),
+    amount numeric(12,2),
+    remaining numeric(12,2) check (remaining >= 0),
+    earned_at timestamp default now(),
+    expires_at timestamp not null,
+    expired_at timestamp,
+    foreign key (user_id) references users (user_id) on delete cascade
+);
+
+create index if not exists point_lots_active_idx on point_lots (user_id, expires_at) where remaining > 0 and expired_at is null;
+create index if not exists point_lots_due_idx on point_lots (expires_at) where remaining > 0 and expired_at is null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists point_lots;
+-- +goose StatementEnd
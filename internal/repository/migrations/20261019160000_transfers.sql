@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists transfers
+(
+    id bigserial primary key,
+    from_user_id integer,
+    to_user_id integer,
+    amount numeric(12,2) check (amount > 0),
+    created_at timestamp default now(),
+    foreign key (from_user_id) references users (user_id) on delete cascade,
+    foreign key (to_user_id) references users (user_id) on delete cascade
+);
+
+create index if not exists transfers_from_idx on transfers (from_user_id, created_at);
+create index if not exists transfers_to_idx on transfers (to_user_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists transfers;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table withdrawns add column if not exists refunded numeric(12,2) not null default 0;
+alter table withdrawns add constraint withdrawns_refunded_check check (refunded >= 0 and refunded <= withdrawn);
+
+create table if not exists withdrawal_refunds
+(
+    id bigserial primary key,
+    order_num varchar(32),
+    amount numeric(12,2) check (amount > 0),
+    reason text not null default '',
+    created_at timestamp default now(),
+    foreign key (order_num) references withdrawns (order_num) on delete cascade
+);
+
+create index if not exists withdrawal_refunds_order_idx on withdrawal_refunds (order_num, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists withdrawal_refunds;
+alter table withdrawns drop constraint if exists withdrawns_refunded_check;
+alter table withdrawns drop column if exists refunded;
+-- +goose StatementEnd
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table balance add column if not exists held numeric(12,2) not null default 0;
+alter table balance add constraint balance_held_check check (held >= 0);
+
+create table if not exists holds
+(
+    id bigserial primary key,
+    user_id integer,
+    order_num varchar(32) not null,
+    amount numeric(12,2) check (amount > 0),
+    status varchar(16) not null default 'HELD',
+    created_at timestamp default now(),
+    expires_at timestamp not null,
+    resolved_at timestamp,
+    foreign key (user_id) references users (user_id) on delete cascade
+);
+
+-- на один заказ не больше одного действующего резерва
+create unique index if not exists holds_active_order_idx on holds (order_num) where status = 'HELD';
+create index if not exists holds_due_idx on holds (expires_at) where status = 'HELD';
+create index if not exists holds_user_idx on holds (user_id, id);
+
+-- баланс пользователя считается по всем его счетам (user:<id>, hold:<id>)
+create index if not exists ledger_entries_user_idx on ledger_entries (user_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists ledger_entries_user_idx;
+drop table if exists holds;
+alter table balance drop constraint if exists balance_held_check;
+alter table balance drop column if exists held;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists user_tiers
+(
+    user_id integer primary key,
+    tier varchar(32) not null,
+    accrued_12m numeric(12,2) not null default 0,
+    changed_at timestamp default now(),
+    updated_at timestamp default now(),
+    foreign key (user_id) references users (user_id) on delete cascade
+);
+
+create index if not exists ledger_entries_accrual_idx on ledger_entries (user_id, created_at) where entry_type = 'accrual';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists ledger_entries_accrual_idx;
+drop table if exists user_tiers;
+-- +goose StatementEnd
@@ -0,0 +1,41 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists campaigns
+(
+    id serial primary key,
+    name varchar(128) not null,
+    starts_at timestamp not null,
+    ends_at timestamp not null,
+    -- сегмент: уровень программы лояльности, список пользователей, префикс номера заказа (null - любые)
+    tier varchar(32),
+    user_ids integer[],
+    order_prefix varchar(32),
+    -- бонус = начисление * (multiplier - 1) + bonus
+    multiplier numeric(6,3) not null default 1 check (multiplier >= 1),
+    bonus numeric(12,2) not null default 0 check (bonus >= 0),
+    active boolean not null default true,
+    created_at timestamp default now(),
+    check (ends_at > starts_at)
+);
+
+create index if not exists campaigns_window_idx on campaigns (starts_at, ends_at) where active;
+
+create table if not exists campaign_awards
+(
+    id bigserial primary key,
+    campaign_id integer not null,
+    order_num varchar(32) not null,
+    user_id integer,
+    amount numeric(12,2) check (amount > 0),
+    created_at timestamp default now(),
+    unique (campaign_id, order_num),
+    foreign key (campaign_id) references campaigns (id) on delete cascade,
+    foreign key (user_id) references users (user_id) on delete cascade
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists campaign_awards;
+drop table if exists campaigns;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table users add column if not exists referral_code varchar(16);
+update users set referral_code = upper(substr(md5(random()::text || user_id::text), 1, 8)) where referral_code is null;
+create unique index if not exists users_referral_code_idx on users (referral_code);
+
+-- пользователь может быть приглашен только один раз - при регистрации
+create table if not exists referrals
+(
+    referred_user_id integer primary key,
+    referrer_user_id integer not null,
+    created_at timestamp default now(),
+    -- первый обработанный заказ приглашенного и момент начисления бонусов
+    order_num varchar(32),
+    rewarded_at timestamp,
+    referrer_bonus numeric(12,2),
+    referred_bonus numeric(12,2),
+    check (referred_user_id <> referrer_user_id),
+    foreign key (referred_user_id) references users (user_id) on delete cascade,
+    foreign key (referrer_user_id) references users (user_id) on delete cascade
+);
+
+create index if not exists referrals_referrer_idx on referrals (referrer_user_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists referrals;
+drop index if exists users_referral_code_idx;
+alter table users drop column if exists referral_code;
+-- +goose StatementEnd
@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- исправления, сделанные сверкой балансов
+create table if not exists reconciliation_audit
+(
+    id bigserial primary key,
+    run_started_at timestamp not null,
+    kind varchar(32) not null,
+    user_id integer,
+    order_num varchar(32),
+    expected numeric(12,2) not null,
+    actual numeric(12,2) not null,
+    ledger_tx_id bigint,
+    created_at timestamp default now()
+);
+
+create index if not exists ledger_entries_order_idx on ledger_entries (order_num) where order_num is not null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists ledger_entries_order_idx;
+drop table if exists reconciliation_audit;
+-- +goose StatementEnd
@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table queue add column if not exists attempts integer not null default 0;
+alter table queue add column if not exists next_attempt_at timestamp not null default now();
+alter table queue add column if not exists last_error text;
+alter table queue add column if not exists dead_lettered_at timestamp;
+
+create index if not exists queue_ready_idx on queue (next_attempt_at) where not in_handling and dead_lettered_at is null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists queue_ready_idx;
+alter table queue drop column if exists dead_lettered_at;
+alter table queue drop column if exists last_error;
+alter table queue drop column if exists next_attempt_at;
+alter table queue drop column if exists attempts;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table queue add column if not exists claimed_by text;
+alter table queue add column if not exists claimed_until timestamp;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+alter table queue drop column if exists claimed_until;
+alter table queue drop column if exists claimed_by;
+-- +goose StatementEnd
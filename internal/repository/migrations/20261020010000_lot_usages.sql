@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists lot_usages
+(
+    id bigserial primary key,
+    lot_id bigint,
+    withdrawal_order varchar(32),
+    amount numeric(12,2),
+    restored numeric(12,2) default 0 check (restored <= amount),
+    foreign key (lot_id) references point_lots (id) on delete cascade
+);
+
+create index if not exists lot_usages_withdrawal_idx on lot_usages (withdrawal_order) where withdrawal_order is not null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists lot_usages;
+-- +goose StatementEnd
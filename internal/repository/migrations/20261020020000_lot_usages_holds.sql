@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+alter table lot_usages add column if not exists hold_id bigint references holds (id) on delete cascade;
+
+create index if not exists lot_usages_hold_idx on lot_usages (hold_id) where hold_id is not null;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists lot_usages_hold_idx;
+alter table lot_usages drop column if exists hold_id;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+create index if not exists user_events_created_at_idx on user_events (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop index if exists user_events_created_at_idx;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- номер заказа резервируется в orders при создании резерва баллов
+insert into orders (order_num, user_id)
+select order_num, user_id from holds where status = 'HELD'
+on conflict do nothing;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+delete from orders o using holds h
+where h.order_num = o.order_num and h.status = 'HELD'
+and not exists (select 1 from withdrawns w where w.order_num = o.order_num)
+and not exists (select 1 from accruals a where a.order_num = o.order_num);
+-- +goose StatementEnd
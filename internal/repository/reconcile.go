@@ -0,0 +1,247 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// версия миграции, которой введен журнал баллов. Заказы, обработанные до нее,
+// вошли в журнал входящими остатками и по отдельности не сверяются
+const ledgerMigrationVersion = 20261019140000
+
+// виды расхождений сверки
+const (
+	MismatchAvailable       = "available"
+	MismatchWithdrawn       = "withdrawn"
+	MismatchHeld            = "held"
+	MismatchOrderAccrual    = "order_accrual"
+	MismatchOrderWithdrawal = "order_withdrawal"
+)
+
+// ledgerStartSQL - момент ввода журнала баллов
+var ledgerStartSQL = fmt.Sprintf("coalesce((select max(tstamp) from goose_db_version where version_id = %d and is_applied), '-infinity'::timestamp)",
+	ledgerMigrationVersion)
+
+// Reconcile сверяет журнал баллов с таблицами accruals и withdrawns по заказам, обработанным после
+// ввода журнала, и кэш balance - с журналом. С repair расхождения исправляются: по заказам - проводками
+// журнала на разницу, кэш - значениями из журнала. Каждое исправление записывается в reconciliation_audit
+func (db *DBT) Reconcile(ctx context.Context, repair bool) (ReconcileReport, error) {
+	res := ReconcileReport{StartedAt: time.Now(), Mismatches: make([]Mismatch, 0)}
+
+	orders, err := db.orderMismatches(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, m := range orders {
+		if repair {
+			m = db.repair(ctx, res.StartedAt, m, db.repairOrder)
+		}
+		res.add(m)
+	}
+
+	// кэш сверяется после исправления заказов: исправления меняют журнал
+	sql := "select count(*) from balance;"
+	err = db.pool.QueryRow(ctx, sql).Scan(&res.Users)
+	if err != nil {
+		return res, err
+	}
+	cache, err := db.cacheMismatches(ctx)
+	if err != nil {
+		return res, err
+	}
+	for _, m := range cache {
+		if repair {
+			m = db.repair(ctx, res.StartedAt, m, db.repairCache)
+		}
+		res.add(m)
+	}
+
+	res.FinishedAt = time.Now()
+	return res, nil
+}
+
+func (r *ReconcileReport) add(m Mismatch) {
+	r.Mismatches = append(r.Mismatches, m)
+	if m.Repaired {
+		r.Repaired++
+	}
+}
+
+// orderMismatches находит заказы, сумма которых в журнале отличается от accruals и withdrawns
+func (db *DBT) orderMismatches(ctx context.Context) ([]Mismatch, error) {
+	sql := "select $1::text, o.user_id, a.order_num, a.accrual, coalesce(l.amount, 0) from accruals a\n" +
+		"join orders o on o.order_num = a.order_num\n" +
+		"left join (select order_num, sum(amount) as amount from ledger_entries where entry_type = $3 and user_id is not null group by order_num) l\n" +
+		"on l.order_num = a.order_num\n" +
+		"where a.status = $5 and a.processed_at >= " + ledgerStartSQL + " and a.accrual <> coalesce(l.amount, 0)\n" +
+		"union all\n" +
+		"select $2::text, o.user_id, w.order_num, w.withdrawn - w.refunded, coalesce(-l.amount, 0) from withdrawns w\n" +
+		"join orders o on o.order_num = w.order_num\n" +
+		"left join (select order_num, sum(amount) as amount from ledger_entries where entry_type in ($4, $6) and user_id is not null group by order_num) l\n" +
+		"on l.order_num = w.order_num\n" +
+		"where w.processed_at >= " + ledgerStartSQL + " and w.withdrawn - w.refunded <> coalesce(-l.amount, 0)\n" +
+		"order by 2, 3;"
+	rows, err := db.pool.Query(ctx, sql, MismatchOrderAccrual, MismatchOrderWithdrawal, EntryAccrual, EntryWithdrawal, AccrualProcessed, EntryRefund)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]Mismatch, 0)
+	for rows.Next() {
+		m := Mismatch{}
+		err = rows.Scan(&m.Kind, &m.UserID, &m.Order, &m.Expected, &m.Actual)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// cacheMismatches находит пользователей, у которых кэш balance отличается от журнала
+func (db *DBT) cacheMismatches(ctx context.Context) ([]Mismatch, error) {
+	sql := "select b.user_id, b.available, b.withdrawn, b.held,\n" +
+		"coalesce(sum(l.amount) filter (where l.account = 'user:' || b.user_id), 0),\n" +
+		"coalesce(-sum(l.amount) filter (where l.entry_type in ($1, $2)), 0),\n" +
+		"coalesce(sum(l.amount) filter (where l.account like 'hold:%'), 0)\n" +
+		"from balance b left join ledger_entries l on l.user_id = b.user_id\n" +
+		"group by b.user_id, b.available, b.withdrawn, b.held order by b.user_id;"
+	rows, err := db.pool.Query(ctx, sql, EntryWithdrawal, EntryRefund)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]Mismatch, 0)
+	for rows.Next() {
+		var userID int
+		var cached, ledger Balance
+		err = rows.Scan(&userID, &cached.Current, &cached.Withdrawn, &cached.Held, &ledger.Current, &ledger.Withdrawn, &ledger.Held)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, balanceMismatches(userID, ledger, cached)...)
+	}
+	return res, rows.Err()
+}
+
+func balanceMismatches(userID int, ledger, cached Balance) []Mismatch {
+	var res []Mismatch
+	if ledger.Current != cached.Current {
+		res = append(res, Mismatch{Kind: MismatchAvailable, UserID: userID, Expected: ledger.Current, Actual: cached.Current})
+	}
+	if ledger.Withdrawn != cached.Withdrawn {
+		res = append(res, Mismatch{Kind: MismatchWithdrawn, UserID: userID, Expected: ledger.Withdrawn, Actual: cached.Withdrawn})
+	}
+	if ledger.Held != cached.Held {
+		res = append(res, Mismatch{Kind: MismatchHeld, UserID: userID, Expected: ledger.Held, Actual: cached.Held})
+	}
+	return res
+}
+
+// repair исправляет расхождение в отдельной транзакции под блокировкой строки balance пользователя.
+// fix перепроверяет расхождение (его могла устранить параллельная операция) и возвращает tx_id проводки
+func (db *DBT) repair(ctx context.Context, runStartedAt time.Time, m Mismatch, fix func(ctx context.Context, tx pgx.Tx, m Mismatch) (bool, *int64, error)) Mismatch {
+	err := func() error {
+		tx, err := db.pool.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+
+		_, err = tx.Exec(ctx, "select 1 from balance where user_id = $1 for update;", m.UserID)
+		if err != nil {
+			return err
+		}
+		fixed, txID, err := fix(ctx, tx, m)
+		if err != nil || !fixed {
+			return err
+		}
+
+		sql := "insert into reconciliation_audit (run_started_at, kind, user_id, order_num, expected, actual, ledger_tx_id)\n" +
+			"values ($1::timestamptz, $2, $3, nullif($4, ''), $5, $6, $7);"
+		_, err = tx.Exec(ctx, sql, runStartedAt.Format(time.RFC3339Nano), m.Kind, m.UserID, m.Order, m.Expected, m.Actual, txID)
+		if err != nil {
+			return err
+		}
+		err = addBalanceEvent(ctx, tx, m.UserID)
+		if err != nil {
+			return err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return fmt.Errorf("unable to commit: %w", err)
+		}
+		m.Repaired = true
+		return nil
+	}()
+	if err != nil {
+		m.Error = err.Error()
+		db.log.Infow("reconciliation repair failed", "kind", m.Kind, "userID", m.UserID, "order", m.Order, "error", err)
+	}
+	return m
+}
+
+// repairOrder проводит по журналу разницу между суммой заказа в accruals/withdrawns и журналом
+// и обновляет кэш balance на ту же разницу
+func (db *DBT) repairOrder(ctx context.Context, tx pgx.Tx, m Mismatch) (bool, *int64, error) {
+	var actual points.Amount
+	var err error
+	if m.Kind == MismatchOrderAccrual {
+		sql := "select coalesce(sum(amount), 0) from ledger_entries where order_num = $1 and entry_type = $2 and user_id is not null;"
+		err = tx.QueryRow(ctx, sql, m.Order, EntryAccrual).Scan(&actual)
+	} else {
+		sql := "select coalesce(-sum(amount), 0) from ledger_entries where order_num = $1 and entry_type in ($2, $3) and user_id is not null;"
+		err = tx.QueryRow(ctx, sql, m.Order, EntryWithdrawal, EntryRefund).Scan(&actual)
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	delta := m.Expected - actual
+	if delta == 0 {
+		return false, nil, nil
+	}
+
+	if m.Kind == MismatchOrderAccrual {
+		err = movePoints(ctx, tx, EntryAccrual, m.Order, systemPosting(accountAccrual, 0), userPosting(m.UserID, 0), delta)
+		if err == nil {
+			_, err = tx.Exec(ctx, "update balance set available = available + $1 where user_id = $2;", delta, m.UserID)
+		}
+	} else {
+		err = movePoints(ctx, tx, EntryWithdrawal, m.Order, userPosting(m.UserID, 0), systemPosting(accountRedemption, 0), delta)
+		if err == nil {
+			_, err = tx.Exec(ctx, "update balance set available = available - $1, withdrawn = withdrawn + $1 where user_id = $2;", delta, m.UserID)
+		}
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	var txID int64
+	err = tx.QueryRow(ctx, "select currval('ledger_tx_seq');").Scan(&txID)
+	return err == nil, &txID, err
+}
+
+// repairCache записывает в кэш balance значения из журнала
+func (db *DBT) repairCache(ctx context.Context, tx pgx.Tx, m Mismatch) (bool, *int64, error) {
+	sql := "select coalesce(sum(amount) filter (where account = $2), 0),\n" +
+		"coalesce(-sum(amount) filter (where entry_type in ($3, $4)), 0),\n" +
+		"coalesce(sum(amount) filter (where account like 'hold:%'), 0)\n" +
+		"from ledger_entries where user_id = $1;"
+	ledger := Balance{}
+	err := tx.QueryRow(ctx, sql, m.UserID, userAccount(m.UserID), EntryWithdrawal, EntryRefund).Scan(&ledger.Current, &ledger.Withdrawn, &ledger.Held)
+	if err != nil {
+		return false, nil, err
+	}
+
+	sql1 := "update balance set available = $1, withdrawn = $2, held = $3 where user_id = $4\n" +
+		"and (available, withdrawn, held) is distinct from ($1, $2, $3);"
+	tag, err := tx.Exec(ctx, sql1, ledger.Current, ledger.Withdrawn, ledger.Held, m.UserID)
+	if err != nil {
+		return false, nil, err
+	}
+	return tag.RowsAffected() > 0, nil, nil
+}
@@ -0,0 +1,129 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// статусы приглашения
+const (
+	ReferralPending  = "PENDING"
+	ReferralRewarded = "REWARDED"
+)
+
+// ReferralBonus - бонусы за приглашение: пригласившему и приглашенному
+type ReferralBonus struct {
+	Referrer points.Amount
+	Referred points.Amount
+}
+
+// SetReferralBonus задает бонусы за приглашение
+func (db *DBT) SetReferralBonus(b ReferralBonus) {
+	db.referralBonus = b
+}
+
+// addReferral связывает нового пользователя с пригласившим по коду приглашения.
+// Приглашение возможно только при регистрации, поэтому приглашенный не может оказаться
+// пригласившим своего пригласившего - циклы исключены, а приглашение самого себя запрещено проверкой в БД
+func addReferral(ctx context.Context, tx pgx.Tx, userID int, code string) error {
+	var referrerID int
+	err := tx.QueryRow(ctx, "select user_id from users where referral_code = upper($1);", code).Scan(&referrerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrUnknownReferralCode
+	}
+	if err != nil {
+		return err
+	}
+	if referrerID == userID {
+		return ErrUnknownReferralCode
+	}
+
+	_, err = tx.Exec(ctx, "insert into referrals (referred_user_id, referrer_user_id) values ($1, $2);", userID, referrerID)
+	return err
+}
+
+// rewardReferral начисляет бонусы за приглашение после первого обработанного заказа приглашенного.
+// Строка приглашения помечается в той же транзакции, поэтому бонусы начисляются ровно один раз
+func (db *DBT) rewardReferral(ctx context.Context, tx pgx.Tx, userID int, order string) error {
+	b := db.referralBonus
+	if b.Referrer <= 0 && b.Referred <= 0 {
+		return nil
+	}
+
+	var referrerID int
+	sql := "update referrals set rewarded_at = now(), order_num = $2, referrer_bonus = $3, referred_bonus = $4\n" +
+		"where referred_user_id = $1 and rewarded_at is null returning referrer_user_id;"
+	err := tx.QueryRow(ctx, sql, userID, order, b.Referrer, b.Referred).Scan(&referrerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, credit := range []struct {
+		userID int
+		amount points.Amount
+	}{{userID, b.Referred}, {referrerID, b.Referrer}} {
+		if credit.amount <= 0 {
+			continue
+		}
+		_, err = tx.Exec(ctx, "update balance set available = available + $1 where user_id = $2;", credit.amount, credit.userID)
+		if err != nil {
+			return err
+		}
+		err = movePoints(ctx, tx, EntryReferralBonus, order, systemPosting(accountReferral, 0), userPosting(credit.userID, 0), credit.amount)
+		if err != nil {
+			return err
+		}
+		err = db.addLot(ctx, tx, credit.userID, order, credit.amount)
+		if err != nil {
+			return err
+		}
+		err = addBalanceEvent(ctx, tx, credit.userID)
+		if err != nil {
+			return err
+		}
+	}
+	db.log.Debugw("referral rewarded", "referrer", referrerID, "referred", userID, "order", order)
+	return nil
+}
+
+// Referrals возвращает код приглашения пользователя и статистику приглашений
+func (db *DBT) Referrals(ctx context.Context, userID int) (ReferralStats, error) {
+	res := ReferralStats{Referrals: make([]ReferralItem, 0, 4)}
+	err := db.pool.QueryRow(ctx, "select referral_code from users where user_id = $1;", userID).Scan(&res.Code)
+	if err != nil {
+		return res, err
+	}
+
+	sql := "select created_at, rewarded_at, coalesce(referrer_bonus, 0) from referrals where referrer_user_id = $1 order by created_at;"
+	rows, err := db.pool.Query(ctx, sql, userID)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item := ReferralItem{Status: ReferralPending}
+		var createdAt time.Time
+		var rewardedAt *time.Time
+		err = rows.Scan(&createdAt, &rewardedAt, &item.Bonus)
+		if err != nil {
+			return res, err
+		}
+		item.JoinedAt = createdAt.Format(time.RFC3339)
+		if rewardedAt != nil {
+			item.Status = ReferralRewarded
+			item.RewardedAt = rewardedAt.Format(time.RFC3339)
+			res.Rewarded++
+			res.Earned += item.Bonus
+		}
+		res.Invited++
+		res.Referrals = append(res.Referrals, item)
+	}
+	return res, rows.Err()
+}
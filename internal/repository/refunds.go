@@ -0,0 +1,138 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// RefundWithdrawal возвращает пользователю amount баллов по списанию на заказ order.
+// amount = 0 - возврат всей еще не возвращенной суммы. Строка списания блокируется,
+// поэтому параллельные возвраты не могут превысить сумму списания
+func (db *DBT) RefundWithdrawal(ctx context.Context, order string, amount points.Amount, reason string) (RefundItem, error) {
+	res := RefundItem{Order: order, Reason: reason}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID int
+	var withdrawn, refunded points.Amount
+	sql := "select o.user_id, w.withdrawn, w.refunded from withdrawns w\n" +
+		"join orders o on o.order_num = w.order_num where w.order_num = $1 for update of w;"
+	err = tx.QueryRow(ctx, sql, order).Scan(&userID, &withdrawn, &refunded)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return res, ErrWithdrawalNotFound
+	}
+	if err != nil {
+		return res, err
+	}
+
+	rest := withdrawn - refunded
+	if rest <= 0 {
+		return res, ErrAlreadyRefunded
+	}
+	if amount == 0 {
+		amount = rest
+	}
+	if amount > rest {
+		return res, ErrRefundExceedsWithdrawal
+	}
+	res.Amount = amount
+
+	// возвращенные баллы попадают в партии, из которых были списаны, с прежним сроком сгорания
+	// (партии блокируются до строки balance); остаток без партий сгорает как новое начисление
+	lotRest, err := restoreLots(ctx, tx, "u.withdrawal_order = $1", order, amount)
+	if err != nil {
+		return res, err
+	}
+	err = db.addLot(ctx, tx, userID, order, lotRest)
+	if err != nil {
+		return res, err
+	}
+
+	sql1 := "update withdrawns set refunded = refunded + $1 where order_num = $2;"
+	_, err = tx.Exec(ctx, sql1, amount, order)
+	if err != nil {
+		return res, err
+	}
+	sql2 := "update balance set available = available + $1, withdrawn = withdrawn - $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql2, amount, userID)
+	if err != nil {
+		return res, err
+	}
+	err = movePoints(ctx, tx, EntryRefund, order, systemPosting(accountRedemption, 0), userPosting(userID, 0), amount)
+	if err != nil {
+		return res, err
+	}
+
+	sql3 := "insert into withdrawal_refunds (order_num, amount, reason) values ($1, $2, $3) returning id, created_at;"
+	err = tx.QueryRow(ctx, sql3, order, amount, reason).Scan(&res.ID, &res.CreatedAtGo)
+	if err != nil {
+		return res, err
+	}
+	res.CreatedAt = res.CreatedAtGo.Format(time.RFC3339)
+
+	// уведомления подписчиков (SSE)
+	err = addEvent(ctx, tx, userID, EventWithdrawalRefunded, refundEvent{Order: order, Amount: amount, Status: refundStatus(withdrawn, refunded+amount)})
+	if err != nil {
+		return res, err
+	}
+	err = addBalanceEvent(ctx, tx, userID)
+	if err != nil {
+		return res, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return res, fmt.Errorf("unable to commit: %w", err)
+	}
+	return res, nil
+}
+
+// WithdrawalRefunds возвращает историю возвратов по списанию на заказ order
+func (db *DBT) WithdrawalRefunds(ctx context.Context, order string) ([]RefundItem, error) {
+	var exists bool
+	err := db.pool.QueryRow(ctx, "select exists(select 1 from withdrawns where order_num = $1);", order).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWithdrawalNotFound
+	}
+
+	sql := "select id, order_num, amount, reason, created_at from withdrawal_refunds where order_num = $1 order by id;"
+	rows, err := db.pool.Query(ctx, sql, order)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]RefundItem, 0, 4)
+	for rows.Next() {
+		item := RefundItem{}
+		err = rows.Scan(&item.ID, &item.Order, &item.Amount, &item.Reason, &item.CreatedAtGo)
+		if err != nil {
+			return nil, err
+		}
+		item.CreatedAt = item.CreatedAtGo.Format(time.RFC3339)
+		res = append(res, item)
+	}
+	return res, rows.Err()
+}
+
+// refundStatus - статус возврата списания для истории списаний
+func refundStatus(withdrawn, refunded points.Amount) string {
+	switch {
+	case refunded <= 0:
+		return ""
+	case refunded < withdrawn:
+		return RefundPartial
+	default:
+		return RefundFull
+	}
+}
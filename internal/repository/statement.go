@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// Statement строит выписку по счету пользователя за период [from, to) по журналу баллов.
+// В выписку попадают все движения: начисления, списания, возвраты, переводы, сгорание и резервы.
+// Нулевой from - выписка с открытия счета
+func (db *DBT) Statement(ctx context.Context, userID int, from, to time.Time) (Statement, error) {
+	res := Statement{To: to.Format(time.RFC3339), Entries: make([]StatementEntry, 0, 16)}
+
+	// границы передаются строкой с часовым поясом: столбцы created_at хранят время сервера БД
+	fromArg := "-infinity"
+	if !from.IsZero() {
+		fromArg = from.Format(time.RFC3339Nano)
+		res.From = from.Format(time.RFC3339)
+	}
+	toArg := to.Format(time.RFC3339Nano)
+
+	sql := "select coalesce(sum(amount), 0) from ledger_entries where account = $1 and created_at < $2::timestamptz;"
+	err := db.pool.QueryRow(ctx, sql, userAccount(userID), fromArg).Scan(&res.Opening)
+	if err != nil {
+		return res, err
+	}
+
+	sql1 := "select created_at, entry_type, coalesce(order_num, ''), amount from ledger_entries\n" +
+		"where account = $1 and created_at >= $2::timestamptz and created_at < $3::timestamptz order by created_at, id;"
+	rows, err := db.pool.Query(ctx, sql1, userAccount(userID), fromArg, toArg)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+
+	balance := res.Opening
+	for rows.Next() {
+		e := StatementEntry{}
+		var at time.Time
+		err = rows.Scan(&at, &e.Type, &e.Order, &e.Amount)
+		if err != nil {
+			return res, err
+		}
+		balance += e.Amount
+		e.Date = at.Format(time.RFC3339)
+		e.Balance = balance
+		res.Entries = append(res.Entries, e)
+	}
+	res.Closing = balance
+	return res, rows.Err()
+}
@@ -0,0 +1,174 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/antonevtu/go-musthave-diploma/internal/tiers"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// SetLoyaltyTiers задает уровни программы лояльности. Пустой список - уровни отключены
+func (db *DBT) SetLoyaltyTiers(t tiers.Tiers) {
+	db.tiers = t
+}
+
+// accruedLastYear возвращает сумму баллов, начисленных пользователю за последние 12 месяцев
+func accruedLastYear(ctx context.Context, q queryRower, userID int) (points.Amount, error) {
+	var accrued points.Amount
+	sql := "select coalesce(sum(amount), 0) from ledger_entries\n" +
+		"where user_id = $1 and account = $2 and entry_type = $3 and created_at > now() - interval '12 months';"
+	err := q.QueryRow(ctx, sql, userID, userAccount(userID), EntryAccrual).Scan(&accrued)
+	return accrued, err
+}
+
+// applyTier умножает начисление на коэффициент текущего уровня пользователя
+func (db *DBT) applyTier(ctx context.Context, tx pgx.Tx, userID int, accrual points.Amount) (points.Amount, error) {
+	if len(db.tiers) == 0 || accrual <= 0 {
+		return accrual, nil
+	}
+	accrued, err := accruedLastYear(ctx, tx, userID)
+	if err != nil {
+		return accrual, err
+	}
+	return db.tiers.Apply(accrued, accrual), nil
+}
+
+// currentTier возвращает уровень пользователя по начислениям за последние 12 месяцев на момент вызова.
+// Пустая строка - уровни отключены
+func (db *DBT) currentTier(ctx context.Context, q queryRower, userID int) (string, error) {
+	if len(db.tiers) == 0 {
+		return "", nil
+	}
+	accrued, err := accruedLastYear(ctx, q, userID)
+	if err != nil {
+		return "", err
+	}
+	cur, _, _ := db.tiers.For(accrued)
+	return cur.Name, nil
+}
+
+// RefreshTiers пересчитывает сохраненные уровни пользователей: начисления старше 12 месяцев
+// выходят из окна, и уровень может понизиться без новых начислений. Возвращает количество смен уровня
+func (db *DBT) RefreshTiers(ctx context.Context) (int, error) {
+	if len(db.tiers) == 0 {
+		return 0, nil
+	}
+	sql := "select t.user_id, t.tier, coalesce(sum(l.amount), 0) from user_tiers t\n" +
+		"left join ledger_entries l on l.user_id = t.user_id and l.account = 'user:' || t.user_id\n" +
+		"and l.entry_type = $1 and l.created_at > now() - interval '12 months'\n" +
+		"group by t.user_id, t.tier;"
+	rows, err := db.pool.Query(ctx, sql, EntryAccrual)
+	if err != nil {
+		return 0, err
+	}
+	stale := make([]int, 0)
+	for rows.Next() {
+		var userID int
+		var tier string
+		var accrued points.Amount
+		err = rows.Scan(&userID, &tier, &accrued)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if cur, _, _ := db.tiers.For(accrued); cur.Name != tier {
+			stale = append(stale, userID)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for i, userID := range stale {
+		err = db.refreshTier(ctx, userID)
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(stale), nil
+}
+
+func (db *DBT) refreshTier(ctx context.Context, userID int) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = db.updateTier(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// updateTier пересчитывает уровень пользователя после начисления. При смене уровня
+// подписчикам отправляется событие tier.changed
+func (db *DBT) updateTier(ctx context.Context, tx pgx.Tx, userID int) error {
+	if len(db.tiers) == 0 {
+		return nil
+	}
+	accrued, err := accruedLastYear(ctx, tx, userID)
+	if err != nil {
+		return err
+	}
+	cur, _, _ := db.tiers.For(accrued)
+
+	var prev string
+	sql := "select tier from user_tiers where user_id = $1 for update;"
+	err = tx.QueryRow(ctx, sql, userID).Scan(&prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	sql1 := "insert into user_tiers (user_id, tier, accrued_12m) values ($1, $2, $3)\n" +
+		"on conflict (user_id) do update set accrued_12m = excluded.accrued_12m, updated_at = now(),\n" +
+		"changed_at = case when user_tiers.tier <> excluded.tier then now() else user_tiers.changed_at end, tier = excluded.tier;"
+	_, err = tx.Exec(ctx, sql1, userID, cur.Name, accrued)
+	if err != nil {
+		return err
+	}
+
+	if prev != cur.Name {
+		return addEvent(ctx, tx, userID, EventTierChanged, tierEvent{Previous: prev, Tier: cur.Name})
+	}
+	return nil
+}
+
+// Profile возвращает профиль пользователя с уровнем программы лояльности и прогрессом до следующего.
+// Уровень считается по начислениям за последние 12 месяцев на момент запроса
+func (db *DBT) Profile(ctx context.Context, userID int) (Profile, error) {
+	res := Profile{}
+	var registeredAt time.Time
+	err := db.pool.QueryRow(ctx, "select login, registered_at, referral_code from users where user_id = $1;", userID).Scan(&res.Login, &registeredAt, &res.ReferralCode)
+	if err != nil {
+		return res, err
+	}
+	res.RegisteredAt = registeredAt.Format(time.RFC3339)
+
+	res.Accrued12m, err = accruedLastYear(ctx, db.pool, userID)
+	if err != nil {
+		return res, err
+	}
+
+	cur, next, ok := db.tiers.For(res.Accrued12m)
+	if !ok {
+		return res, nil
+	}
+	res.Tier = cur.Name
+	res.Multiplier = json.Number(cur.MultiplierText)
+	if next != nil {
+		res.NextTier = next.Name
+		res.NextTierThreshold = next.Threshold
+		res.ToNextTier = next.Threshold - res.Accrued12m
+	}
+	return res, nil
+}
@@ -0,0 +1,153 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// Transfer переводит amount баллов пользователю с логином toLogin. Строки balance обоих пользователей
+// блокируются в порядке user_id, чтобы встречные переводы не приводили к взаимной блокировке.
+// dailyLimit - максимальная сумма переводов пользователя за сутки, 0 - без ограничения
+func (db *DBT) Transfer(ctx context.Context, userID int, toLogin string, amount, dailyLimit points.Amount) (TransferItem, error) {
+	res := TransferItem{Direction: TransferOut, Login: toLogin, Amount: amount}
+
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback(ctx)
+
+	var toUserID int
+	sql := "select user_id from users where login = $1;"
+	err = tx.QueryRow(ctx, sql, toLogin).Scan(&toUserID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return res, ErrUnknownLogin
+	}
+	if err != nil {
+		return res, err
+	}
+	if toUserID == userID {
+		return res, ErrSelfTransfer
+	}
+
+	// списание из партий баллов отправителя (партии блокируются до строк balance)
+	parts, err := consumeLots(ctx, tx, userID, amount)
+	if err != nil {
+		return res, err
+	}
+
+	sql1 := "select user_id, available from balance where user_id in ($1, $2) order by user_id for update;"
+	rows, err := tx.Query(ctx, sql1, userID, toUserID)
+	if err != nil {
+		return res, err
+	}
+	var available points.Amount
+	for rows.Next() {
+		var id int
+		var av points.Amount
+		err = rows.Scan(&id, &av)
+		if err != nil {
+			rows.Close()
+			return res, err
+		}
+		if id == userID {
+			available = av
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return res, err
+	}
+	if available < amount {
+		return res, ErrNotEnoughFunds
+	}
+
+	if dailyLimit > 0 {
+		var sent points.Amount
+		sql2 := "select coalesce(sum(amount), 0) from transfers where from_user_id = $1 and created_at >= date_trunc('day', now());"
+		err = tx.QueryRow(ctx, sql2, userID).Scan(&sent)
+		if err != nil {
+			return res, err
+		}
+		if sent+amount > dailyLimit {
+			return res, &LimitError{Rule: "transfer_daily_limit"}
+		}
+	}
+
+	sql3 := "update balance set available = available - $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql3, amount, userID)
+	if err != nil {
+		return res, err
+	}
+	sql4 := "update balance set available = available + $1 where user_id = $2;"
+	_, err = tx.Exec(ctx, sql4, amount, toUserID)
+	if err != nil {
+		return res, err
+	}
+	// баллы переходят к получателю со сроками сгорания партий отправителя
+	rest := amount
+	for _, part := range parts {
+		err = addLotUntil(ctx, tx, toUserID, "", part.amount, part.expiresAt)
+		if err != nil {
+			return res, err
+		}
+		rest -= part.amount
+	}
+	err = db.addLot(ctx, tx, toUserID, "", rest)
+	if err != nil {
+		return res, err
+	}
+	err = movePoints(ctx, tx, EntryTransfer, "", userPosting(userID, 0), userPosting(toUserID, 0), amount)
+	if err != nil {
+		return res, err
+	}
+
+	sql5 := "insert into transfers (from_user_id, to_user_id, amount) values ($1, $2, $3) returning id, created_at;"
+	err = tx.QueryRow(ctx, sql5, userID, toUserID, amount).Scan(&res.ID, &res.CreatedAtGo)
+	if err != nil {
+		return res, err
+	}
+	res.CreatedAt = res.CreatedAtGo.Format(time.RFC3339)
+
+	// уведомления подписчиков (SSE)
+	err = addBalanceEvent(ctx, tx, userID)
+	if err != nil {
+		return res, err
+	}
+	err = addBalanceEvent(ctx, tx, toUserID)
+	if err != nil {
+		return res, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return res, fmt.Errorf("unable to commit: %w", err)
+	}
+	return res, nil
+}
+
+func (db *DBT) GetTransfers(ctx context.Context, userID int) (TransfersList, error) {
+	sql := "select t.id, case when t.from_user_id = $1 then $2 else $3 end, u.login, t.amount, t.created_at from transfers t\n" +
+		"join users u on u.user_id = case when t.from_user_id = $1 then t.to_user_id else t.from_user_id end\n" +
+		"where t.from_user_id = $1 or t.to_user_id = $1 order by t.created_at;"
+	rows, err := db.pool.Query(ctx, sql, userID, TransferOut, TransferIn)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(TransfersList, 0, 10)
+	item := TransferItem{}
+	for rows.Next() {
+		err = rows.Scan(&item.ID, &item.Direction, &item.Login, &item.Amount, &item.CreatedAtGo)
+		if err != nil {
+			return nil, err
+		}
+		item.CreatedAt = item.CreatedAtGo.Format(time.RFC3339)
+		res = append(res, item)
+	}
+	return res, rows.Err()
+}
@@ -0,0 +1,184 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"time"
+)
+
+// максимальное количество записей журнала доставки в ответе
+const maxWebhookLog = 100
+
+// addWebhookEvent записывает событие в outbox и создает доставки всем активным подписчикам
+// в рамках транзакции tx. Отправкой занимается диспетчер вебхуков
+func addWebhookEvent(ctx context.Context, tx pgx.Tx, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	sql := "insert into webhook_outbox (event_type, payload) values ($1, $2) returning id;"
+	var eventID int64
+	err = tx.QueryRow(ctx, sql, eventType, string(payload)).Scan(&eventID)
+	if err != nil {
+		return err
+	}
+
+	sql1 := "insert into webhook_deliveries (outbox_id, subscription_id)\nselect $1, id from webhook_subscriptions where active and $2 = any(event_types);"
+	_, err = tx.Exec(ctx, sql1, eventID, eventType)
+	return err
+}
+
+func (db *DBT) AddWebhookSubscription(ctx context.Context, sub WebhookSubscription) (WebhookSubscription, error) {
+	sql := "insert into webhook_subscriptions (partner, url, event_types, secret) values ($1, $2, $3, $4) returning id, active, created_at;"
+	err := db.pool.QueryRow(ctx, sql, sub.Partner, sub.URL, sub.EventTypes, sub.Secret).Scan(&sub.ID, &sub.Active, &sub.CreatedAt)
+	return sub, err
+}
+
+func (db *DBT) WebhookSubscriptions(ctx context.Context) ([]WebhookSubscription, error) {
+	sql := "select id, partner, url, event_types, active, created_at from webhook_subscriptions order by id;"
+	rows, err := db.pool.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]WebhookSubscription, 0, 10)
+	for rows.Next() {
+		sub := WebhookSubscription{}
+		err = rows.Scan(&sub.ID, &sub.Partner, &sub.URL, &sub.EventTypes, &sub.Active, &sub.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, sub)
+	}
+	return res, rows.Err()
+}
+
+// DeactivateWebhookSubscription отключает подписку. Недоставленные события подписки отменяются
+func (db *DBT) DeactivateWebhookSubscription(ctx context.Context, id int) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := "update webhook_subscriptions set active = false where id = $1;"
+	tag, err := tx.Exec(ctx, sql, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+
+	sql1 := "update webhook_deliveries set status = $1, last_error = 'subscription deactivated' where subscription_id = $2 and status = $3;"
+	_, err = tx.Exec(ctx, sql1, WebhookFailed, id, WebhookPending)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
+
+func (db *DBT) WebhookDeliveryLog(ctx context.Context, subscriptionID int) ([]WebhookLogItem, error) {
+	sql := "select id from webhook_subscriptions where id = $1;"
+	err := db.pool.QueryRow(ctx, sql, subscriptionID).Scan(&subscriptionID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sql1 := "select l.delivery_id, d.outbox_id, o.event_type, l.attempt, coalesce(l.response_code, 0), coalesce(l.error, ''), l.duration_ms, l.created_at\n" +
+		"from webhook_delivery_log l\n" +
+		"join webhook_deliveries d on d.id = l.delivery_id\n" +
+		"join webhook_outbox o on o.id = d.outbox_id\n" +
+		"where d.subscription_id = $1 order by l.id desc limit $2;"
+	rows, err := db.pool.Query(ctx, sql1, subscriptionID, maxWebhookLog)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]WebhookLogItem, 0, 10)
+	for rows.Next() {
+		item := WebhookLogItem{}
+		err = rows.Scan(&item.DeliveryID, &item.EventID, &item.EventType, &item.Attempt, &item.ResponseCode, &item.Error, &item.DurationMs, &item.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, item)
+	}
+	return res, rows.Err()
+}
+
+// ClaimWebhookDeliveries захватывает доставки, время которых наступило. Захват продлевает
+// next_attempt_at на lease, поэтому после падения процесса доставка будет повторена
+func (db *DBT) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	sql := "update webhook_deliveries d set attempts = d.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)\n" +
+		"from webhook_subscriptions s, webhook_outbox o\n" +
+		"where d.id in (select id from webhook_deliveries where status = $3 and next_attempt_at <= now() order by next_attempt_at limit $1 for update skip locked)\n" +
+		"and s.id = d.subscription_id and o.id = d.outbox_id\n" +
+		"returning d.id, d.outbox_id, d.attempts, s.url, s.secret, o.event_type, o.payload;"
+	rows, err := db.pool.Query(ctx, sql, limit, lease.Seconds(), WebhookPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make([]WebhookDelivery, 0, limit)
+	for rows.Next() {
+		d := WebhookDelivery{}
+		var payload string
+		err = rows.Scan(&d.ID, &d.EventID, &d.Attempt, &d.URL, &d.Secret, &d.EventType, &payload)
+		if err != nil {
+			return nil, err
+		}
+		d.Payload = []byte(payload)
+		res = append(res, d)
+	}
+	return res, rows.Err()
+}
+
+// RecordWebhookAttempt пишет попытку в журнал доставки и обновляет состояние доставки
+func (db *DBT) RecordWebhookAttempt(ctx context.Context, a WebhookAttempt) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	sql := "insert into webhook_delivery_log (delivery_id, attempt, response_code, error, duration_ms) values ($1, $2, nullif($3, 0), nullif($4, ''), $5);"
+	_, err = tx.Exec(ctx, sql, a.DeliveryID, a.Attempt, a.ResponseCode, a.Error, a.Duration.Milliseconds())
+	if err != nil {
+		return err
+	}
+
+	switch a.Status {
+	case WebhookDelivered:
+		sql1 := "update webhook_deliveries set status = $1, delivered_at = now(), last_error = null where id = $2;"
+		_, err = tx.Exec(ctx, sql1, a.Status, a.DeliveryID)
+	case WebhookPending:
+		sql1 := "update webhook_deliveries set next_attempt_at = now() + make_interval(secs => $1), last_error = $2 where id = $3;"
+		_, err = tx.Exec(ctx, sql1, a.RetryIn.Seconds(), a.Error, a.DeliveryID)
+	default:
+		sql1 := "update webhook_deliveries set status = $1, last_error = $2 where id = $3;"
+		_, err = tx.Exec(ctx, sql1, a.Status, a.Error, a.DeliveryID)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("unable to commit: %w", err)
+	}
+	return nil
+}
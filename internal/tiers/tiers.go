@@ -0,0 +1,87 @@
+package tiers
+
+import (
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// Tier - уровень программы лояльности: порог баллов, начисленных за последние 12 месяцев,
+// и коэффициент, на который умножаются начисления системы расчета
+type Tier struct {
+	Name       string
+	Threshold  points.Amount
+	Multiplier *big.Rat
+	// коэффициент в том виде, в котором он задан в конфигурации
+	MultiplierText string
+}
+
+// Tiers - уровни по возрастанию порога. Пустой список - уровни отключены
+type Tiers []Tier
+
+// UnmarshalText разбирает уровни из конфигурации: "BRONZE:0:1,SILVER:1000:1.1,GOLD:5000:1.25"
+// (имя:порог:коэффициент). Порог первого уровня должен быть равен нулю
+func (t *Tiers) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if s == "" {
+		*t = nil
+		return nil
+	}
+
+	res := make(Tiers, 0, 3)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return fmt.Errorf("invalid tier %q: must be name:threshold:multiplier", item)
+		}
+		threshold, err := points.Parse(parts[1])
+		if err != nil {
+			return fmt.Errorf("invalid tier %q threshold: %w", item, err)
+		}
+		// коэффициент отдается в профиле пользователя как есть - допускается только десятичная запись
+		m, err := points.ParseMultiplier(parts[2])
+		if err != nil || m.Sign() <= 0 {
+			return fmt.Errorf("invalid tier %q multiplier", item)
+		}
+		res = append(res, Tier{Name: parts[0], Threshold: threshold, Multiplier: m, MultiplierText: parts[2]})
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Threshold < res[j].Threshold })
+	if res[0].Threshold != 0 {
+		return fmt.Errorf("threshold of the first tier %s must be 0", res[0].Name)
+	}
+	for i := 1; i < len(res); i++ {
+		if res[i].Threshold == res[i-1].Threshold {
+			return fmt.Errorf("tiers %s and %s have the same threshold", res[i-1].Name, res[i].Name)
+		}
+	}
+	*t = res
+	return nil
+}
+
+// For возвращает уровень для суммы начислений accrued и следующий уровень (nil - уровень максимальный).
+// ok = false, если уровни не заданы
+func (t Tiers) For(accrued points.Amount) (cur Tier, next *Tier, ok bool) {
+	if len(t) == 0 {
+		return Tier{}, nil, false
+	}
+	i := sort.Search(len(t), func(i int) bool { return t[i].Threshold > accrued }) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i+1 < len(t) {
+		next = &t[i+1]
+	}
+	return t[i], next, true
+}
+
+// Apply умножает начисление на коэффициент уровня, соответствующего сумме начислений accrued
+func (t Tiers) Apply(accrued, accrual points.Amount) points.Amount {
+	cur, _, ok := t.For(accrued)
+	if !ok {
+		return accrual
+	}
+	return accrual.MulRat(cur.Multiplier)
+}
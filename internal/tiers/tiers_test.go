@@ -0,0 +1,40 @@
+package tiers
+
+import (
+	"github.com/antonevtu/go-musthave-diploma/internal/points"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTiers(t *testing.T) {
+	var tt Tiers
+	require.NoError(t, tt.UnmarshalText([]byte("GOLD:5000:1.25, BRONZE:0:1, SILVER:1000:1.1")))
+	require.Len(t, tt, 3)
+
+	cur, next, ok := tt.For(0)
+	require.True(t, ok)
+	assert.Equal(t, "BRONZE", cur.Name)
+	assert.Equal(t, "SILVER", next.Name)
+
+	cur, next, _ = tt.For(points.Amount(100000))
+	assert.Equal(t, "SILVER", cur.Name)
+	assert.Equal(t, "GOLD", next.Name)
+
+	cur, next, _ = tt.For(points.Amount(1000000))
+	assert.Equal(t, "GOLD", cur.Name)
+	assert.Nil(t, next)
+
+	assert.Equal(t, points.Amount(12500), tt.Apply(points.Amount(500000), points.Amount(10000)))
+	assert.Equal(t, points.Amount(11000), tt.Apply(points.Amount(100000), points.Amount(10000)))
+
+	var empty Tiers
+	require.NoError(t, empty.UnmarshalText([]byte("")))
+	assert.Equal(t, points.Amount(10000), empty.Apply(points.Amount(500000), points.Amount(10000)))
+
+	assert.Error(t, tt.UnmarshalText([]byte("SILVER:1000:1.1")))
+	assert.Error(t, tt.UnmarshalText([]byte("BRONZE:0:0")))
+	assert.Error(t, tt.UnmarshalText([]byte("BRONZE:0")))
+	assert.Error(t, tt.UnmarshalText([]byte("BRONZE:0:5/4")))
+	assert.Error(t, tt.UnmarshalText([]byte("BRONZE:0:1e0")))
+}
@@ -0,0 +1,180 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// заголовки запроса вебхука
+const (
+	HeaderEvent     = "X-Gophermart-Event"
+	HeaderDelivery  = "X-Gophermart-Delivery"
+	HeaderTimestamp = "X-Gophermart-Timestamp"
+	HeaderSignature = "X-Gophermart-Signature"
+)
+
+const batchSize = 20
+
+// запас аренды пачки доставок сверх таймаутов запросов - на запись результатов попыток
+const leaseMargin = time.Minute
+
+type Store interface {
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]repository.WebhookDelivery, error)
+	RecordWebhookAttempt(ctx context.Context, a repository.WebhookAttempt) error
+}
+
+// Dispatcher отправляет события из outbox подписчикам с повторами и журналом доставки
+type Dispatcher struct {
+	store       Store
+	client      *http.Client
+	log         *zap.SugaredLogger
+	maxAttempts int
+	interval    time.Duration
+	retryBase   time.Duration
+	retryMax    time.Duration
+	// аренда захваченной пачки: доставки отправляются по очереди, каждая - не дольше таймаута запроса
+	lease time.Duration
+}
+
+func New(store Store, cfgApp cfg.Config, zapLog *zap.SugaredLogger) *Dispatcher {
+	timeout := time.Duration(cfgApp.WebhookTimeout) * time.Millisecond
+	return &Dispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: timeout},
+		log:         zapLog,
+		maxAttempts: cfgApp.WebhookMaxAttempts,
+		interval:    time.Duration(cfgApp.WebhookPollInterval) * time.Millisecond,
+		retryBase:   time.Duration(cfgApp.WebhookRetryBase) * time.Second,
+		retryMax:    time.Duration(cfgApp.WebhookRetryMax) * time.Second,
+		lease:       batchSize*timeout + leaseMargin,
+	}
+}
+
+// Sign вычисляет подпись тела запроса: hex(HMAC-SHA256(secret, timestamp + "." + body)).
+// Партнер проверяет подпись тем же секретом, timestamp защищает от повторного воспроизведения
+func Sign(secret string, timestamp int64, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	h.Write([]byte("."))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		n, err := d.DispatchOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			d.log.Infow("webhook dispatch failed", "error", err)
+		}
+		// полная пачка - вероятно, есть еще готовые доставки
+		if n == batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// DispatchOnce отправляет одну пачку готовых доставок и возвращает их количество
+func (d *Dispatcher) DispatchOnce(ctx context.Context) (int, error) {
+	leaseEnd := time.Now().Add(d.lease)
+	deliveries, err := d.store.ClaimWebhookDeliveries(ctx, batchSize, d.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, del := range deliveries {
+		// доставка, которая может не успеть до конца аренды, не отправляется: после аренды пачку
+		// захватит другой экземпляр сервиса и отправит ее повторно
+		if time.Until(leaseEnd) < d.client.Timeout {
+			d.log.Infow("webhook lease is running out, deliveries left for the next claim", "count", len(deliveries)-i)
+			break
+		}
+		a := d.deliver(ctx, del)
+		err = d.store.RecordWebhookAttempt(ctx, a)
+		if err != nil {
+			return len(deliveries), err
+		}
+	}
+	return len(deliveries), nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, del repository.WebhookDelivery) repository.WebhookAttempt {
+	a := repository.WebhookAttempt{DeliveryID: del.ID, Attempt: del.Attempt}
+
+	start := time.Now()
+	code, err := d.post(ctx, del)
+	a.Duration = time.Since(start)
+	a.ResponseCode = code
+
+	switch {
+	case err == nil && code >= 200 && code < 300:
+		a.Status = repository.WebhookDelivered
+		d.log.Debugw("webhook delivered", "delivery", del.ID, "url", del.URL)
+		return a
+	case err != nil:
+		a.Error = err.Error()
+	default:
+		a.Error = fmt.Sprintf("unexpected response status %d", code)
+	}
+
+	if del.Attempt >= d.maxAttempts {
+		a.Status = repository.WebhookFailed
+		d.log.Infow("webhook delivery failed", "delivery", del.ID, "url", del.URL, "attempts", del.Attempt, "error", a.Error)
+		return a
+	}
+	a.Status = repository.WebhookPending
+	a.RetryIn = d.backoff(del.Attempt)
+	return a
+}
+
+func (d *Dispatcher) post(ctx context.Context, del repository.WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, del.URL, bytes.NewReader(del.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, del.EventType)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(del.EventID, 10))
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(HeaderSignature, Sign(del.Secret, ts, del.Payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// backoff - экспоненциальная задержка перед повтором: retryBase * 2^(attempt-1), не более retryMax
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.retryBase
+	for i := 1; i < attempt && delay < d.retryMax; i++ {
+		delay *= 2
+	}
+	if delay > d.retryMax {
+		delay = d.retryMax
+	}
+	return delay
+}
@@ -0,0 +1,201 @@
+package webhooks
+
+import (
+	"context"
+	"github.com/antonevtu/go-musthave-diploma/internal/cfg"
+	"github.com/antonevtu/go-musthave-diploma/internal/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore - хранилище доставок в памяти: отдает доставку, пока она в статусе PENDING
+type fakeStore struct {
+	mu       sync.Mutex
+	delivery repository.WebhookDelivery
+	status   string
+	attempts []repository.WebhookAttempt
+}
+
+func (s *fakeStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]repository.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status != repository.WebhookPending {
+		return nil, nil
+	}
+	s.delivery.Attempt++
+	return []repository.WebhookDelivery{s.delivery}, nil
+}
+
+func (s *fakeStore) RecordWebhookAttempt(ctx context.Context, a repository.WebhookAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = a.Status
+	s.attempts = append(s.attempts, a)
+	return nil
+}
+
+func newTestDispatcher(store Store, maxAttempts int) *Dispatcher {
+	cfgApp := cfg.Config{
+		WebhookMaxAttempts:  maxAttempts,
+		WebhookTimeout:      1000,
+		WebhookPollInterval: 10,
+		WebhookRetryBase:    1,
+		WebhookRetryMax:     4,
+	}
+	return New(store, cfgApp, zap.NewNop().Sugar())
+}
+
+func TestDispatcherRetriesAndSigns(t *testing.T) {
+	const secret = "partner-secret"
+	payload := []byte(`{"order":"5404361084409447","status":"PROCESSED","accrual":500}`)
+
+	var mu sync.Mutex
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		stamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, Sign(secret, stamp, body), r.Header.Get(HeaderSignature))
+		assert.Equal(t, repository.WebhookOrderProcessed, r.Header.Get(HeaderEvent))
+		assert.Equal(t, "42", r.Header.Get(HeaderDelivery))
+		assert.Equal(t, payload, body)
+
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		// первые две попытки получатель недоступен
+		if calls <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	store := &fakeStore{
+		status: repository.WebhookPending,
+		delivery: repository.WebhookDelivery{
+			ID:        1,
+			EventID:   42,
+			URL:       ts.URL,
+			Secret:    secret,
+			EventType: repository.WebhookOrderProcessed,
+			Payload:   payload,
+		},
+	}
+	d := newTestDispatcher(store, 5)
+
+	for i := 0; i < 3; i++ {
+		n, err := d.DispatchOnce(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, 1, n)
+	}
+
+	require.Len(t, store.attempts, 3)
+	assert.Equal(t, repository.WebhookPending, store.attempts[0].Status)
+	assert.Equal(t, http.StatusServiceUnavailable, store.attempts[0].ResponseCode)
+	assert.Equal(t, time.Second, store.attempts[0].RetryIn)
+	assert.Equal(t, 2*time.Second, store.attempts[1].RetryIn)
+	assert.Equal(t, repository.WebhookDelivered, store.attempts[2].Status)
+	assert.Equal(t, repository.WebhookDelivered, store.status)
+
+	// доставленное событие повторно не отправляется
+	n, err := d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestDispatcherGivesUp(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	store := &fakeStore{
+		status:   repository.WebhookPending,
+		delivery: repository.WebhookDelivery{ID: 1, EventID: 1, URL: ts.URL, Secret: "s", EventType: repository.WebhookOrderInvalid},
+	}
+	d := newTestDispatcher(store, 3)
+
+	for i := 0; i < 5; i++ {
+		_, err := d.DispatchOnce(context.Background())
+		require.NoError(t, err)
+	}
+
+	require.Len(t, store.attempts, 3)
+	assert.Equal(t, repository.WebhookFailed, store.status)
+	assert.Equal(t, 3, store.attempts[2].Attempt)
+	assert.NotEmpty(t, store.attempts[2].Error)
+}
+
+func TestBackoffIsCapped(t *testing.T) {
+	d := newTestDispatcher(&fakeStore{}, 10)
+	assert.Equal(t, time.Second, d.backoff(1))
+	assert.Equal(t, 4*time.Second, d.backoff(3))
+	assert.Equal(t, 4*time.Second, d.backoff(9))
+}
+
+// batchStore - хранилище с пачкой доставок: отдает их один раз и запоминает аренду
+type batchStore struct {
+	mu         sync.Mutex
+	deliveries []repository.WebhookDelivery
+	lease      time.Duration
+	attempts   []repository.WebhookAttempt
+}
+
+func (s *batchStore) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]repository.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lease = lease
+	res := s.deliveries
+	s.deliveries = nil
+	return res, nil
+}
+
+func (s *batchStore) RecordWebhookAttempt(ctx context.Context, a repository.WebhookAttempt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts = append(s.attempts, a)
+	return nil
+}
+
+func TestDispatcherSlowEndpointStaysWithinLease(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	store := &batchStore{}
+	for i := 1; i <= 4; i++ {
+		store.deliveries = append(store.deliveries, repository.WebhookDelivery{ID: int64(i), EventID: int64(i), URL: ts.URL, Secret: "s", Attempt: 1})
+	}
+	d := newTestDispatcher(store, 5)
+	d.client.Timeout = 200 * time.Millisecond
+
+	// аренда по умолчанию покрывает пачку, отправляемую по очереди с полным таймаутом каждого запроса
+	assert.GreaterOrEqual(t, d.lease, batchSize*time.Second)
+
+	// аренда на три медленные доставки: четвертая не отправляется, чтобы не отправить ее дважды
+	d.lease = 450 * time.Millisecond
+	started := time.Now()
+	n, err := d.DispatchOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, d.lease, store.lease)
+	assert.Less(t, time.Since(started), d.lease)
+	require.Len(t, store.attempts, 3)
+	for _, a := range store.attempts {
+		assert.Equal(t, repository.WebhookDelivered, a.Status)
+	}
+}